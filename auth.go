@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"context"
+	"errors"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+)
+
+// logout logs s out of the tailnet, removing its node key from the
+// state store.
+//
+// The prefs s was running with are kept so that tailscale_up logs the
+// node back in to the same control server, with the same hostname.
+func (s *server) logout(ctx context.Context) error {
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	prefs, err := lc.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	if err := lc.Logout(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.loginPrefs = prefs
+	s.mu.Unlock()
+	return nil
+}
+
+// login starts s with authKey, which may be empty for an interactive
+// login or to reuse the current node key, and waits for it to be running.
+func (s *server) login(ctx context.Context, authKey string) error {
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	prefs := s.loginPrefs
+	s.mu.Unlock()
+	if prefs == nil {
+		if prefs, err = lc.GetPrefs(ctx); err != nil {
+			return err
+		}
+	}
+	prefs.WantRunning = true
+	prefs.LoggedOut = false
+	if err := lc.Start(ctx, ipn.Options{UpdatePrefs: prefs, AuthKey: authKey}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.loginPrefs = nil
+	s.mu.Unlock()
+	return waitRunning(ctx, lc)
+}
+
+// waitRunning waits for the backend behind lc to reach the Running state,
+// starting a login if it needs one, as tsnet.Server.Start does.
+func waitRunning(ctx context.Context, lc *local.Client) error {
+	w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	loggingIn := false
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if n.ErrMessage != nil {
+			return errors.New(*n.ErrMessage)
+		}
+		if n.State == nil {
+			continue
+		}
+		switch *n.State {
+		case ipn.Running:
+			return nil
+		case ipn.NeedsLogin:
+			if !loggingIn {
+				if err := lc.StartLoginInteractive(ctx); err != nil {
+					return err
+				}
+				loggingIn = true
+			}
+		}
+	}
+}
+
+//export TsnetReauth
+func TsnetReauth(sd C.int, authKey *C.char) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	s.s.AuthKey = C.GoString(authKey)
+	return s.recWaitErr(s.login(s.ctx, s.s.AuthKey))
+}
+
+//export TsnetLogout
+func TsnetLogout(sd C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	return s.recWaitErr(s.logout(s.ctx))
+}
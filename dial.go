@@ -0,0 +1,553 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// Policies for choosing among the peers tailscale_dial_tag may connect to.
+const (
+	policyRoundRobin    = "round-robin"
+	policyRandom        = "random"
+	policyLowestLatency = "lowest-latency"
+)
+
+const (
+	// dialTagAttemptTimeout bounds each connection attempt of
+	// tailscale_dial_tag, so that an unresponsive peer does not hold
+	// up trying the next one.
+	dialTagAttemptTimeout = 5 * time.Second
+
+	// dialTagPingTimeout bounds how long the lowest-latency policy
+	// waits for the peers to answer a ping.
+	dialTagPingTimeout = time.Second
+)
+
+// errNoTaggedPeer is returned when no online peer has the tag to dial.
+var errNoTaggedPeer = errors.New("libtailscale: no online peer with tag")
+
+// dialCandidate is a peer tailscale_dial_tag may connect to.
+type dialCandidate struct {
+	name string // MagicDNS name, without the trailing dot
+	ip   netip.Addr
+}
+
+// taggedPeers returns the online peers in nm tagged tag, ordered by
+// name.
+func taggedPeers(nm *netmap.NetworkMap, tag string) []dialCandidate {
+	var cands []dialCandidate
+	for _, p := range nm.Peers {
+		if !p.Tags().ContainsFunc(func(t string) bool { return strings.EqualFold(t, tag) }) || !peerOnline(nm, p) {
+			continue
+		}
+		c := dialCandidate{name: strings.TrimSuffix(p.Name(), ".")}
+		// Prefer IPv4, as ping does.
+		for _, a := range p.Addresses().All() {
+			if a.IsSingleIP() && (!c.ip.IsValid() || a.Addr().Is4() && !c.ip.Is4()) {
+				c.ip = a.Addr()
+			}
+		}
+		if c.ip.IsValid() {
+			cands = append(cands, c)
+		}
+	}
+	slices.SortFunc(cands, func(a, b dialCandidate) int { return cmp.Compare(a.name, b.name) })
+	return cands
+}
+
+// orderCandidates returns the peers tagged tag in the order
+// tailscale_dial_tag tries them under policy.
+func (s *server) orderCandidates(ctx context.Context, tag, policy string) ([]dialCandidate, error) {
+	nm, err := s.netMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cands := taggedPeers(nm, tag)
+	if len(cands) == 0 {
+		return nil, fmt.Errorf("%w %s", errNoTaggedPeer, tag)
+	}
+	switch policy {
+	case policyRoundRobin:
+		s.mu.Lock()
+		if s.dialTagNext == nil {
+			s.dialTagNext = map[string]int{}
+		}
+		i := s.dialTagNext[tag] % len(cands)
+		s.dialTagNext[tag] = i + 1
+		s.mu.Unlock()
+		cands = append(cands[i:], cands[:i]...)
+	case policyRandom:
+		rand.Shuffle(len(cands), func(i, j int) { cands[i], cands[j] = cands[j], cands[i] })
+	case policyLowestLatency:
+		if err := s.sortByLatency(ctx, cands); err != nil {
+			return nil, err
+		}
+	}
+	return cands, nil
+}
+
+// sortByLatency pings cands and sorts them by latency, fastest first.
+// Peers that do not answer within dialTagPingTimeout go last.
+func (s *server) sortByLatency(ctx context.Context, cands []dialCandidate) error {
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTagPingTimeout)
+	defer cancel()
+	latency := make([]time.Duration, len(cands))
+	var wg sync.WaitGroup
+	for i, c := range cands {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latency[i] = dialTagPingTimeout
+			if pr, err := lc.Ping(ctx, c.ip, tailcfg.PingDisco); err == nil && pr.Err == "" {
+				latency[i] = time.Duration(pr.LatencySeconds * float64(time.Second))
+			}
+		}()
+	}
+	wg.Wait()
+	byLatency := make(map[dialCandidate]time.Duration, len(cands))
+	for i, c := range cands {
+		byLatency[c] = latency[i]
+	}
+	slices.SortStableFunc(cands, func(a, b dialCandidate) int { return cmp.Compare(byLatency[a], byLatency[b]) })
+	return nil
+}
+
+// dialTag connects to port on one of the online peers tagged tag, chosen
+// under policy. If connecting fails, the next peer is tried.
+func (s *server) dialTag(ctx context.Context, network, tag string, port uint16, policy string) (net.Conn, error) {
+	cands, err := s.orderCandidates(ctx, tag, policy)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, c := range cands {
+		attemptCtx, cancel := context.WithTimeout(ctx, dialTagAttemptTimeout)
+		conn, err := s.s.Dial(attemptCtx, network, netip.AddrPortFrom(c.ip, port).String())
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+	}
+	return nil, fmt.Errorf("libtailscale: dialing %s: %w", tag, errors.Join(errs...))
+}
+
+//export TsnetDialTag
+func TsnetDialTag(sd C.int, network, tag *C.char, port C.int, policy *C.char, connOut *C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	t := C.GoString(tag)
+	if !strings.HasPrefix(t, "tag:") {
+		s.recErr(fmt.Errorf("libtailscale: invalid tag %q, want tag:NAME", t))
+		return C.EINVAL
+	}
+	if port <= 0 || port > 65535 {
+		s.recErr(fmt.Errorf("libtailscale: invalid port %d", port))
+		return C.EINVAL
+	}
+	var p string
+	if policy != nil {
+		p = C.GoString(policy)
+	}
+	switch p {
+	case "":
+		p = policyRoundRobin
+	case policyRoundRobin, policyRandom, policyLowestLatency:
+	default:
+		s.recErr(fmt.Errorf("libtailscale: unknown dial policy %q, want %s, %s or %s", p, policyRoundRobin, policyRandom, policyLowestLatency))
+		return C.EINVAL
+	}
+
+	netConn, err := s.dialTag(s.ctx, C.GoString(network), t, uint16(port), p)
+	if errors.Is(err, errNoTaggedPeer) {
+		s.recErr(err)
+		return C.ENOENT
+	} else if err != nil {
+		return s.dialErr(s.ctx, err)
+	}
+	if err := newConn(s, netConn, connOut); err != nil {
+		return s.recErr(err)
+	}
+	return 0
+}
+
+// peerIdentity is the JSON object tailscale_dial_verified checks the
+// peer against. Every field that is set must match.
+type peerIdentity struct {
+	ID   tailcfg.StableNodeID `json:",omitempty"` // stable node ID
+	User string               `json:",omitempty"` // login name of the owner of an untagged node
+	Tag  string               `json:",omitempty"` // one of the node's tags
+}
+
+// errPeerMismatch is returned when the peer tailscale_dial_verified
+// connected to is not the expected one.
+var errPeerMismatch = errors.New("libtailscale: peer identity does not match")
+
+// parsePeerIdentity parses the expected identity JSON of
+// tailscale_dial_verified, which must set at least one field.
+func parsePeerIdentity(expected string) (peerIdentity, error) {
+	var want peerIdentity
+	dec := json.NewDecoder(strings.NewReader(expected))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&want); err != nil {
+		return want, fmt.Errorf("libtailscale: invalid expected peer: %w", err)
+	}
+	if want == (peerIdentity{}) {
+		return want, errors.New("libtailscale: expected peer has no ID, User or Tag")
+	}
+	return want, nil
+}
+
+// verifyPeer checks, with WhoIs, that the remote end of c is the node
+// described by want. It returns an error wrapping errPeerMismatch if not.
+func (s *server) verifyPeer(ctx context.Context, c net.Conn, want peerIdentity) error {
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	remote := c.RemoteAddr().String()
+	who, err := lc.WhoIs(ctx, remote)
+	if errors.Is(err, local.ErrPeerNotFound) {
+		return fmt.Errorf("%w: %s is not a tailnet node", errPeerMismatch, remote)
+	} else if err != nil {
+		return err
+	}
+	n := who.Node
+	name := strings.TrimSuffix(n.Name, ".")
+	if want.ID != "" && n.StableID != want.ID {
+		return fmt.Errorf("%w: %s has ID %s, want %s", errPeerMismatch, name, n.StableID, want.ID)
+	}
+	if want.User != "" {
+		if n.IsTagged() {
+			return fmt.Errorf("%w: %s is tagged, want owner %s", errPeerMismatch, name, want.User)
+		}
+		if who.UserProfile == nil || !strings.EqualFold(who.UserProfile.LoginName, want.User) {
+			return fmt.Errorf("%w: %s is not owned by %s", errPeerMismatch, name, want.User)
+		}
+	}
+	if want.Tag != "" && !slices.ContainsFunc(n.Tags, func(t string) bool { return strings.EqualFold(t, want.Tag) }) {
+		return fmt.Errorf("%w: %s is not tagged %s", errPeerMismatch, name, want.Tag)
+	}
+	return nil
+}
+
+//export TsnetDialVerified
+func TsnetDialVerified(sd C.int, network, addr, expected *C.char, connOut *C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	want, err := parsePeerIdentity(C.GoString(expected))
+	if err != nil {
+		s.recErr(err)
+		return C.EINVAL
+	}
+	if err := s.start(); err != nil {
+		return s.recErr(err)
+	}
+	netConn, err := s.s.Dial(s.ctx, C.GoString(network), C.GoString(addr))
+	if err != nil {
+		return s.dialErr(s.ctx, err)
+	}
+	if err := s.verifyPeer(s.ctx, netConn, want); err != nil {
+		netConn.Close()
+		if errors.Is(err, errPeerMismatch) {
+			s.recErr(err)
+			return C.EPERM
+		}
+		return s.dialErr(s.ctx, err)
+	}
+	if err := newConn(s, netConn, connOut); err != nil {
+		return s.recErr(err)
+	}
+	return 0
+}
+
+// dialTLS connects to addr over TCP and performs a TLS handshake,
+// verifying the server's certificate.
+//
+// addr is "host:port", or just a host for port 443. If host is a peer,
+// by MagicDNS name or Tailscale IP, the certificate must be for the
+// peer's full MagicDNS name, e.g. "web.tailnet-1234.ts.net", which is the
+// name its ts.net certificate has. Otherwise it must be for host.
+func (s *server) dialTLS(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "443"
+	}
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	c, err := s.s.Dial(ctx, "tcp", net.JoinHostPort(host, port)) // waits for Running
+	if err != nil {
+		return nil, err
+	}
+
+	// Name the peer actually dialed, rather than looking host up in
+	// the netmap separately.
+	serverName := host
+	if ap, err := netip.ParseAddrPort(c.RemoteAddr().String()); err == nil {
+		if nm, err := s.netMap(ctx); err == nil {
+			if p, ok := nm.PeerByTailscaleIP(ap.Addr()); ok {
+				serverName = strings.TrimSuffix(p.Name(), ".")
+			}
+		}
+	}
+	tc := tls.Client(c, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    s.tlsRootCAs,
+	})
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+//export TsnetDialTLS
+func TsnetDialTLS(sd C.int, addr *C.char, connOut *C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	netConn, err := s.dialTLS(s.ctx, C.GoString(addr))
+	if err != nil {
+		var verr *tls.CertificateVerificationError
+		if errors.As(err, &verr) {
+			s.recErr(err)
+			return C.EPERM
+		}
+		return s.dialErr(s.ctx, err)
+	}
+	if err := newConn(s, netConn, connOut); err != nil {
+		return s.recErr(err)
+	}
+	return 0
+}
+
+// dialErr records err, from dialing with ctx on s, and returns the error
+// code for it: ECANCELED if s was closed, ETIMEDOUT if ctx timed out, or
+// -1 otherwise.
+func (s *server) dialErr(ctx context.Context, err error) C.int {
+	s.recErr(err)
+	switch {
+	case s.ctx.Err() != nil:
+		return C.ECANCELED
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return C.ETIMEDOUT
+	}
+	return -1
+}
+
+//export TsnetDialTimeout
+func TsnetDialTimeout(sd C.int, network, addr *C.char, timeoutMillis C.int, connOut *C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	if timeoutMillis <= 0 {
+		s.recErr(errors.New("libtailscale: dial timeout must be positive"))
+		return C.EINVAL
+	}
+	if err := s.start(); err != nil {
+		return s.recErr(err)
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, time.Duration(timeoutMillis)*time.Millisecond)
+	defer cancel()
+	netConn, err := s.s.Dial(ctx, C.GoString(network), C.GoString(addr))
+	if err != nil {
+		return s.dialErr(ctx, err)
+	}
+	if err := newConn(s, netConn, connOut); err != nil {
+		return s.recErr(err)
+	}
+	return 0
+}
+
+// asyncDials tracks the tailscale_conns returned by tailscale_dial_async
+// that have not been connected, or whose dial failed and C has not yet
+// closed, keyed by the FD given to C.
+var asyncDials struct {
+	mu sync.Mutex
+	m  map[C.int]*asyncDial
+}
+
+type asyncDial struct {
+	s     *server
+	done  bool
+	err   error // set if the dial failed
+	errno C.int // returned by tailscale_conn_error if err != nil
+}
+
+// fillSocket writes to the socket fd until its send buffer is full, so
+// that it does not poll as writable until the peer reads what was written.
+// It returns the number of bytes written.
+func fillSocket(fd int) (int64, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return 0, err
+	}
+	var n int64
+	var b [1 << 16]byte
+	for {
+		m, err := syscall.Write(fd, b[:])
+		if err == syscall.EAGAIN {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		n += int64(m)
+	}
+	return n, syscall.SetNonblock(fd, false)
+}
+
+//export TsnetDialAsync
+func TsnetDialAsync(sd C.int, network, addr *C.char, connOut *C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	netw, address := C.GoString(network), C.GoString(addr)
+	if err := s.start(); err != nil {
+		return s.recErr(err)
+	}
+
+	// As with tailscale_dial, C gets one side of a socketpair(2). Until
+	// the dial completes, its send buffer is kept full of filler that the
+	// Go side discards on success, so C can poll for writability as it
+	// would after a non-blocking connect(2).
+	fds, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return s.recErr(err)
+	}
+	filler, err := fillSocket(fds[0])
+	if err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return s.recErr(err)
+	}
+	fdC := C.int(fds[0])
+	d := &asyncDial{s: s}
+	r := os.NewFile(uintptr(fds[1]), "socketpair-r")
+
+	asyncDials.mu.Lock()
+	if asyncDials.m == nil {
+		asyncDials.m = map[C.int]*asyncDial{}
+	}
+	asyncDials.m[fdC] = d
+	asyncDials.mu.Unlock()
+
+	// Claim fdC in conns now. If C closes it during the dial and the
+	// number is reused for another conn, that conn takes the entry
+	// over, and the dialed conn must not.
+	c := &conn{s: s.s, r: r}
+	registerConn(fdC, c)
+
+	go func() {
+		netConn, err := s.s.Dial(s.ctx, netw, address)
+		errno := C.int(-1)
+		var en syscall.Errno
+		if s.ctx.Err() != nil {
+			errno = C.ECANCELED
+		} else if errors.As(err, &en) {
+			errno = C.int(en)
+		}
+		// Record the result before discarding the filler, which makes
+		// C's side writable.
+		asyncDials.mu.Lock()
+		d.done, d.err, d.errno = true, err, errno
+		asyncDials.mu.Unlock()
+
+		if _, err := io.CopyN(io.Discard, r, filler); err != nil {
+			s.logf("libtailscale.dial_async: %v", err)
+		}
+		conns.mu.Lock()
+		claimed := conns.m[fdC] == c
+		if claimed && err == nil {
+			c.c = netConn
+		} else if claimed {
+			delete(conns.m, fdC)
+		}
+		conns.mu.Unlock()
+		switch {
+		case err == nil && claimed:
+			c.serve(fdC)
+		case err == nil:
+			netConn.Close()
+			r.Close()
+		default:
+			// C reads EOF, but can still ask for the error with
+			// tailscale_conn_error until it closes its side, which
+			// is when reading r returns EOF.
+			syscall.Shutdown(fds[1], syscall.SHUT_WR)
+			io.Copy(io.Discard, r)
+			r.Close()
+		}
+
+		asyncDials.mu.Lock()
+		if asyncDials.m[fdC] == d {
+			delete(asyncDials.m, fdC)
+		}
+		asyncDials.mu.Unlock()
+	}()
+
+	*connOut = fdC
+	return C.EINPROGRESS
+}
+
+//export TsnetConnError
+func TsnetConnError(connFd C.int) C.int {
+	// Look in asyncDials first: conns may still hold an entry for an
+	// earlier conn with the same fd that C closed with close(2), which
+	// is removed only once its copy goroutines notice.
+	asyncDials.mu.Lock()
+	if d := asyncDials.m[connFd]; d != nil {
+		defer asyncDials.mu.Unlock()
+		switch {
+		case !d.done:
+			return C.EINPROGRESS
+		case d.err != nil:
+			d.s.recErr(d.err)
+			return d.errno
+		}
+		return 0
+	}
+	asyncDials.mu.Unlock()
+
+	conns.mu.Lock()
+	_, ok := conns.m[connFd]
+	conns.mu.Unlock()
+	if !ok {
+		return C.EBADF
+	}
+	return 0
+}
@@ -0,0 +1,391 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include "errno.h"
+import "C"
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolvconffile"
+	"tailscale.com/types/netmap"
+)
+
+const (
+	// dnsUpstreamTimeout bounds a query forwarded to a system nameserver.
+	dnsUpstreamTimeout = 5 * time.Second
+
+	// dnsTCPIdleTimeout is how long a DNS over TCP connection may sit
+	// idle between queries. RFC 7766 recommends on the order of seconds.
+	dnsTCPIdleTimeout = 10 * time.Second
+
+	// maxDNSUDPQueries bounds the UDP queries answered at once. Further
+	// datagrams wait in the socket's receive buffer.
+	maxDNSUDPQueries = 64
+
+	// maxDNSTCPConns bounds the TCP connections served at once. Further
+	// connections wait in the listener's backlog.
+	maxDNSTCPConns = 64
+)
+
+// dnsServer is a DNS server started by tailscale_dns_server.
+//
+// It answers queries for tailnet names with the node's own DNS resolver,
+// the one that serves 100.100.100.100 to tailnet clients, and forwards
+// all other queries to the nameservers in /etc/resolv.conf.
+type dnsServer struct {
+	s      *server
+	mgr    *dns.Manager
+	pc     net.PacketConn
+	ln     net.Listener
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	nm *netmap.NetworkMap // latest netmap, or nil
+}
+
+// startDNSServer starts a DNS server for s on addr, which must be a
+// loopback address. It starts s if it has not been started yet.
+func startDNSServer(s *server, addr string) (*dnsServer, error) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !ap.Addr().IsLoopback() {
+		return nil, fmt.Errorf("libtailscale: DNS server address %v is not a loopback address", ap)
+	}
+	if ap.Port() == 0 {
+		// The caller could not learn the chosen port, and it may
+		// not be free for TCP too.
+		return nil, fmt.Errorf("libtailscale: DNS server address %v has no port", ap)
+	}
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenPacket("udp", ap.String())
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	d := &dnsServer{
+		s:   s,
+		mgr: s.s.Sys().DNSManager.Get(),
+		pc:  pc,
+		ln:  ln,
+	}
+	d.ctx, d.cancel = context.WithCancel(s.ctx)
+
+	go d.watchNetMap(lc)
+	go d.serveUDP()
+	go d.serveTCP()
+	return d, nil
+}
+
+func (d *dnsServer) close() error {
+	d.cancel()
+	d.ln.Close()
+	return d.pc.Close()
+}
+
+// watchNetMap keeps d.nm up to date until d is closed.
+func (d *dnsServer) watchNetMap(lc *local.Client) {
+	for d.ctx.Err() == nil {
+		w, err := lc.WatchIPNBus(d.ctx, ipn.NotifyInitialNetMap)
+		if err == nil {
+			for {
+				n, err := w.Next()
+				if err != nil {
+					break
+				}
+				if n.NetMap != nil {
+					d.mu.Lock()
+					d.nm = n.NetMap
+					d.mu.Unlock()
+				}
+			}
+			w.Close()
+		}
+		select {
+		case <-d.ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (d *dnsServer) serveUDP() {
+	sem := make(chan struct{}, maxDNSUDPQueries)
+	buf := make([]byte, 1<<16)
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-d.ctx.Done():
+			return
+		}
+		n, from, err := d.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		src, err := netip.ParseAddrPort(from.String())
+		if err != nil {
+			<-sem
+			continue
+		}
+		q := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-sem }()
+			if res := d.query(q, "udp", src); res != nil {
+				d.pc.WriteTo(res, from)
+			}
+		}()
+	}
+}
+
+func (d *dnsServer) serveTCP() {
+	sem := make(chan struct{}, maxDNSTCPConns)
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-d.ctx.Done():
+			return
+		}
+		c, err := d.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { <-sem }()
+			d.serveTCPConn(c)
+		}()
+	}
+}
+
+// serveTCPConn serves length-prefixed DNS queries on c until it is
+// closed or idle for dnsTCPIdleTimeout.
+func (d *dnsServer) serveTCPConn(c net.Conn) {
+	defer c.Close()
+	src, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	for {
+		c.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		q, err := readDNSTCP(c)
+		if err != nil {
+			return
+		}
+		res := d.query(q, "tcp", src)
+		if res == nil {
+			return
+		}
+		if err := writeDNSTCP(c, res); err != nil {
+			return
+		}
+	}
+}
+
+// query answers the DNS query q, received over network ("udp" or "tcp")
+// from src. It returns nil if q is not a DNS query worth answering.
+func (d *dnsServer) query(q []byte, network string, src netip.AddrPort) []byte {
+	var p dnsmessage.Parser
+	if _, err := p.Start(q); err != nil {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	nm := d.nm
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(d.ctx, dnsUpstreamTimeout)
+	defer cancel()
+	var res []byte
+	if nodeAnswers(nm, strings.ToLower(question.Name.String())) {
+		res, err = d.mgr.Query(ctx, q, network, src)
+	} else {
+		res, err = d.forward(ctx, q, network)
+	}
+	if err != nil {
+		d.s.logf("libtailscale.dns: %v %v: %v", question.Name, question.Type, err)
+		return dnsServFail(q)
+	}
+	return res
+}
+
+// nodeAnswers reports whether queries for fqdn, which has a trailing dot,
+// should be answered by the node's resolver rather than the system's.
+func nodeAnswers(nm *netmap.NetworkMap, fqdn string) bool {
+	if nm == nil {
+		return false
+	}
+	if len(nm.DNS.Resolvers) > 0 {
+		// The tailnet has its own global nameservers, which the
+		// node forwards everything else to.
+		return true
+	}
+	if suffix := nm.MagicDNSSuffix(); suffix != "" && dnsNameHasSuffix(fqdn, suffix) {
+		return true
+	}
+	if route, _ := splitDNSRoute(nm, fqdn); route != "" {
+		return true
+	}
+	for _, rec := range nm.DNS.ExtraRecords {
+		if strings.EqualFold(strings.TrimSuffix(rec.Name, ".")+".", fqdn) {
+			return true
+		}
+	}
+	// Reverse lookups of Tailscale IPs, in 100.64.0.0/10 and
+	// fd7a:115c:a1e0::/48.
+	return dnsNameHasSuffix(fqdn, "100.in-addr.arpa") ||
+		dnsNameHasSuffix(fqdn, "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa")
+}
+
+// forward sends q to the first system nameserver that answers it.
+func (d *dnsServer) forward(ctx context.Context, q []byte, network string) ([]byte, error) {
+	conf, err := resolvconffile.ParseFile(resolvconffile.Path)
+	if err != nil {
+		return nil, err
+	}
+	self, _ := netip.ParseAddrPort(d.pc.LocalAddr().String())
+	upstreams := dnsUpstreams(conf.Nameservers, self)
+	if len(upstreams) == 0 {
+		return nil, errors.New("no system nameservers")
+	}
+	var dialer net.Dialer
+	for _, ns := range upstreams {
+		var res []byte
+		c, err := dialer.DialContext(ctx, network, ns.String())
+		if err == nil {
+			if deadline, ok := ctx.Deadline(); ok {
+				c.SetDeadline(deadline)
+			}
+			if network == "tcp" {
+				if err = writeDNSTCP(c, q); err == nil {
+					res, err = readDNSTCP(c)
+				}
+			} else if _, err = c.Write(q); err == nil {
+				buf := make([]byte, 1<<16)
+				var n int
+				n, err = c.Read(buf)
+				res = buf[:n]
+			}
+			c.Close()
+		}
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// dnsUpstreams returns the port 53 addresses of nameservers, leaving out
+// self, the address of the DNS server forwarding to them. If
+// tailscale_dns_server listens on a nameserver in /etc/resolv.conf, it
+// must not forward queries to itself.
+func dnsUpstreams(nameservers []netip.Addr, self netip.AddrPort) []netip.AddrPort {
+	var ret []netip.AddrPort
+	for _, ns := range nameservers {
+		ap := netip.AddrPortFrom(ns.Unmap(), 53)
+		if ap != self {
+			ret = append(ret, ap)
+		}
+	}
+	return ret
+}
+
+// readDNSTCP reads a length-prefixed DNS message from r.
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeDNSTCP writes msg to w with a length prefix.
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	_, err := w.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg))))
+	if err == nil {
+		_, err = w.Write(msg)
+	}
+	return err
+}
+
+// dnsServFail returns a SERVFAIL response to the query q.
+func dnsServFail(q []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	h.Response = true
+	h.RecursionAvailable = true
+	h.RCode = dnsmessage.RCodeServerFailure
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	for _, q := range questions {
+		b.Question(q)
+	}
+	res, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+//export TsnetDNSServer
+func TsnetDNSServer(sd C.int, listenAddr *C.char) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	d, err := startDNSServer(s, C.GoString(listenAddr))
+	if err != nil {
+		return s.recErr(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		// tailscale_close ran while d was starting, and has already
+		// closed s.dnsServers.
+		d.close()
+		return C.EBADF
+	}
+	s.dnsServers = append(s.dnsServers, d)
+	return 0
+}
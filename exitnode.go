@@ -0,0 +1,200 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+)
+
+// exitNode is an element of the JSON array written by
+// tailscale_list_exit_nodes, and the object written by
+// tailscale_suggest_exit_node.
+type exitNode struct {
+	ID           tailcfg.StableNodeID
+	Name         string            // MagicDNS name, without the trailing dot
+	TailscaleIPs []string          `json:",omitempty"`
+	Online       bool              `json:",omitempty"`
+	Active       bool              `json:",omitempty"` // the current exit node
+	Location     *tailcfg.Location `json:",omitempty"`
+}
+
+// errNoExitNode is returned when there is no exit node to suggest.
+var errNoExitNode = errors.New("libtailscale: no exit node available")
+
+// listExitNodes returns the peers of s that offer to be an exit node,
+// ordered by name.
+func (s *server) listExitNodes(ctx context.Context) ([]exitNode, error) {
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []exitNode{}
+	for _, ps := range st.Peer {
+		if !ps.ExitNodeOption {
+			continue
+		}
+		n := exitNode{
+			ID:       ps.ID,
+			Name:     strings.TrimSuffix(ps.DNSName, "."),
+			Online:   ps.Online,
+			Active:   ps.ExitNode,
+			Location: ps.Location,
+		}
+		for _, ip := range ps.TailscaleIPs {
+			n.TailscaleIPs = append(n.TailscaleIPs, ip.String())
+		}
+		nodes = append(nodes, n)
+	}
+	slices.SortFunc(nodes, func(a, b exitNode) int { return cmp.Compare(a.Name, b.Name) })
+	return nodes, nil
+}
+
+// setExitNode makes node the exit node of s, or clears the exit node if
+// node is empty.
+//
+// node is a stable node ID, as returned by tailscale_list_exit_nodes and
+// tailscale_suggest_exit_node, or anything the tailscale CLI's
+// --exit-node flag accepts: a Tailscale IP or a MagicDNS name.
+func (s *server) setExitNode(ctx context.Context, node string, allowLAN bool) error {
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	mp := &ipn.MaskedPrefs{
+		ExitNodeIDSet:             true,
+		ExitNodeIPSet:             true,
+		ExitNodeAllowLANAccessSet: true,
+	}
+	mp.ExitNodeAllowLANAccess = allowLAN
+	if node != "" {
+		st, err := lc.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, ps := range st.Peer {
+			if string(ps.ID) == node {
+				mp.ExitNodeID = ps.ID
+				break
+			}
+		}
+		if mp.ExitNodeID.IsZero() {
+			if err := mp.SetExitNodeIP(node, st); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = lc.EditPrefs(ctx, mp)
+	return err
+}
+
+// suggestExitNode returns the exit node the tailnet would suggest for s,
+// based on its DERP latency and the tailnet's exit node policy.
+func (s *server) suggestExitNode(ctx context.Context) (*exitNode, error) {
+	if _, err := s.netMap(ctx); err != nil {
+		return nil, err
+	}
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+	// The suggestion needs a preferred DERP region from a netcheck.
+	// Without one LocalAPI fails with a plain 500 error, which does not
+	// say why, so check for one first.
+	ms, ok := s.s.Sys().MagicSock.GetOK()
+	if !ok {
+		return nil, errNotRunning
+	}
+	if r := ms.GetLastNetcheckReport(ctx); r == nil || r.PreferredDERP == 0 {
+		// The first netcheck has not finished yet.
+		return nil, errNotRunning
+	}
+	res, err := lc.SuggestExitNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if res.ID.IsZero() {
+		return nil, errNoExitNode
+	}
+	n := &exitNode{
+		ID:   res.ID,
+		Name: strings.TrimSuffix(res.Name, "."),
+	}
+	if res.Location.Valid() {
+		n.Location = res.Location.AsStruct()
+	}
+	return n, nil
+}
+
+//export TsnetSetExitNode
+func TsnetSetExitNode(sd C.int, node *C.char, allowLAN C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	var name string
+	if node != nil {
+		name = C.GoString(node)
+	}
+	return s.recErr(s.setExitNode(s.ctx, name, allowLAN != 0))
+}
+
+//export TsnetListExitNodes
+func TsnetListExitNodes(sd C.int, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("list_exit_nodes", buf, buflen)
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	nodes, err := s.listExitNodes(s.ctx)
+	if err != nil {
+		return s.recErr(err)
+	}
+	b, err := json.Marshal(nodes)
+	if err != nil {
+		return s.recErr(err)
+	}
+	return writeOut(out, string(b))
+}
+
+//export TsnetSuggestExitNode
+func TsnetSuggestExitNode(sd C.int, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("suggest_exit_node", buf, buflen)
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	n, err := s.suggestExitNode(s.ctx)
+	if err != nil {
+		s.recErr(err)
+		switch {
+		case errors.Is(err, errNoExitNode):
+			return C.ENOENT
+		case errors.Is(err, errNotRunning):
+			return C.EAGAIN
+		}
+		return -1
+	}
+	b, err := json.Marshal(n)
+	if err != nil {
+		return s.recErr(err)
+	}
+	return writeOut(out, string(b))
+}
@@ -0,0 +1,444 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include "errno.h"
+import "C"
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/proxymux"
+)
+
+// loopback is the server behind tailscale_loopback.
+//
+// It does the same job as tsnet.Server.Loopback, serving a SOCKS5 proxy
+// and the LocalAPI on a single 127.0.0.1 listener, but unlike the tsnet
+// version its credentials can be rotated and its listener stopped without
+// closing the whole tsnet.Server. It also serves an HTTP proxy onto the
+// tailnet for clients that do not speak SOCKS5.
+type loopback struct {
+	s     *server
+	ln    net.Listener
+	hs    *http.Server
+	api   http.Handler // reverse proxy onto the in-memory LocalAPI
+	proxy http.Handler // forwarding proxy for absolute-URI requests
+
+	mu           sync.Mutex
+	proxyCred    string
+	localAPICred string
+	closed       bool
+	conns        map[net.Conn]bool // CONNECT tunnels and SOCKS5 connections, which hs does not close
+}
+
+// startLoopback starts a loopback server for s. It starts s if it has
+// not been started yet.
+func startLoopback(s *server) (*loopback, error) {
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	lb := &loopback{
+		s:  s,
+		ln: ln,
+		api: &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.Out.URL.Scheme = "http"
+				pr.Out.URL.Host = apitype.LocalAPIHost
+				pr.Out.Host = apitype.LocalAPIHost
+				// The in-memory LocalAPI does not check a password.
+				pr.Out.Header.Del("Authorization")
+			},
+			Transport:     &http.Transport{DialContext: lc.Dial},
+			FlushInterval: -1, // for streaming endpoints like watch-ipn-bus
+			ErrorLog:      log.New(logWriter{s}, "", 0),
+		},
+	}
+	lb.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The outbound URL is already the absolute URL the
+			// client asked for. Proxy-Authorization is a hop-by-hop
+			// header and is removed by ReverseProxy.
+		},
+		Transport: &http.Transport{DialContext: s.s.Dial},
+		ErrorLog:  log.New(logWriter{s}, "", 0),
+	}
+	if _, _, err := lb.rotate(); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	lb.hs = &http.Server{
+		Handler:  lb,
+		ErrorLog: log.New(logWriter{s}, "", 0),
+	}
+
+	socksLn, httpLn := proxymux.SplitSOCKSAndHTTP(ln)
+	go func() {
+		if err := lb.hs.Serve(httpLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logf("libtailscale.loopback: localapi serve error: %v", err)
+		}
+	}()
+	go lb.serveSOCKS(socksLn)
+
+	return lb, nil
+}
+
+// creds returns the current proxy and LocalAPI credentials.
+func (lb *loopback) creds() (proxyCred, localAPICred string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.proxyCred, lb.localAPICred
+}
+
+// rotate replaces both credentials with new random values and returns them.
+//
+// Connections authenticated with the old credentials are not affected,
+// only new connections and requests must use the new ones.
+func (lb *loopback) rotate() (proxyCred, localAPICred string, err error) {
+	proxyCred, err = newCred()
+	if err != nil {
+		return "", "", err
+	}
+	localAPICred, err = newCred()
+	if err != nil {
+		return "", "", err
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.proxyCred, lb.localAPICred = proxyCred, localAPICred
+	return proxyCred, localAPICred, nil
+}
+
+// close stops the listener and closes any LocalAPI and proxy connections.
+func (lb *loopback) close() error {
+	lb.mu.Lock()
+	lb.closed = true
+	conns := lb.conns
+	lb.conns = nil
+	lb.mu.Unlock()
+	for c := range conns {
+		c.Close()
+	}
+	lb.hs.Close()
+	return lb.ln.Close()
+}
+
+// trackConn records c to be closed by close. If lb is already closed, it
+// closes c and returns false.
+func (lb *loopback) trackConn(c net.Conn) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.closed {
+		c.Close()
+		return false
+	}
+	if lb.conns == nil {
+		lb.conns = map[net.Conn]bool{}
+	}
+	lb.conns[c] = true
+	return true
+}
+
+// untrackConn forgets c, once the caller has finished with it.
+func (lb *loopback) untrackConn(c net.Conn) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	delete(lb.conns, c)
+}
+
+// trackedConn is a connection recorded with trackConn that is forgotten
+// when it is closed.
+type trackedConn struct {
+	net.Conn
+	lb *loopback
+}
+
+func (c trackedConn) Close() error {
+	c.lb.untrackConn(c.Conn)
+	return c.Conn.Close()
+}
+
+// newCred returns a random 32 character credential.
+func newCred() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// serveSOCKS serves SOCKS5 connections from ln until it is closed.
+func (lb *loopback) serveSOCKS(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if !lb.trackConn(c) {
+			continue
+		}
+		// socks5.Server closes c when done with it, which may be
+		// after serveSOCKSConn returns.
+		go lb.serveSOCKSConn(trackedConn{c, lb})
+	}
+}
+
+func (lb *loopback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect || r.URL.IsAbs() {
+		lb.serveProxy(w, r)
+		return
+	}
+
+	_, localAPICred := lb.creds()
+	if r.Header.Get("Sec-Tailscale") != "localapi" {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "missing 'Sec-Tailscale: localapi' header")
+		return
+	}
+	_, pass, ok := r.BasicAuth()
+	if !ok {
+		http.Error(w, "auth required", http.StatusUnauthorized)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(localAPICred)) == 0 {
+		http.Error(w, "bad password", http.StatusForbidden)
+		return
+	}
+	lb.api.ServeHTTP(w, r)
+}
+
+// serveProxy serves r as an HTTP proxy request, either a CONNECT tunnel
+// or a request for an absolute URI, dialing the target over the tailnet.
+//
+// Clients authenticate with a Proxy-Authorization basic auth header with
+// the username "tsnet" and the proxy credential as the password, the same
+// as for SOCKS5.
+func (lb *loopback) serveProxy(w http.ResponseWriter, r *http.Request) {
+	proxyCred, _ := lb.creds()
+	user, pass, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+	if !ok || user != "tsnet" || subtle.ConstantTimeCompare([]byte(pass), []byte(proxyCred)) == 0 {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="tailscale"`)
+		http.Error(w, "proxy auth required", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method != http.MethodConnect {
+		lb.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	back, err := lb.s.s.Dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		lb.s.logf("libtailscale.loopback: CONNECT %s: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer back.Close()
+	if !lb.trackConn(back) {
+		return
+	}
+	defer lb.untrackConn(back)
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	front, rw, err := hj.Hijack()
+	if err != nil {
+		lb.s.logf("libtailscale.loopback: CONNECT %s: hijack: %v", r.Host, err)
+		return
+	}
+	defer front.Close()
+	if !lb.trackConn(front) {
+		return
+	}
+	defer lb.untrackConn(front)
+
+	if _, err := io.WriteString(front, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		// Anything the client sent after the CONNECT request
+		// is buffered in rw, so copy from it rather than front.
+		_, err := io.Copy(back, rw)
+		if cw, ok := back.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(front, back)
+		if cw, ok := front.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		errc <- err
+	}()
+	<-errc
+	<-errc
+}
+
+// parseProxyAuth parses a Proxy-Authorization header value using the
+// basic authentication scheme.
+func parseProxyAuth(v string) (user, pass string, ok bool) {
+	scheme, enc, ok := strings.Cut(v, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
+
+// logWriter adapts a server's logger to an io.Writer for use with log.Logger.
+type logWriter struct{ s *server }
+
+func (w logWriter) Write(b []byte) (int, error) {
+	w.s.logf("libtailscale.loopback: %s", b)
+	return len(b), nil
+}
+
+// writeCred writes cred into out, which must be defined in C as
+// char cred_out[static 33].
+func writeCred(out *C.char, cred string) error {
+	if len(cred) != 32 {
+		return fmt.Errorf("libtailscale: len(cred)=%d, want 32", len(cred))
+	}
+	b := unsafe.Slice((*byte)(unsafe.Pointer(out)), 33)
+	copy(b, cred)
+	b[32] = '\x00'
+	return nil
+}
+
+//export TsnetLoopback
+func TsnetLoopback(sd C.int, addrOut *C.char, addrLen C.size_t, proxyOut *C.char, localOut *C.char) C.int {
+	// Panic here to ensure we always leave the out values NUL-terminated.
+	if addrOut == nil {
+		panic("loopback_api passed nil addr_out")
+	} else if addrLen == 0 {
+		panic("loopback_api passed addrlen of 0")
+	} else if proxyOut == nil {
+		panic("loopback_api passed nil proxy_cred_out")
+	} else if localOut == nil {
+		panic("loopback_api passed nil local_api_cred_out")
+	}
+
+	// Start out NUL-termianted to cover error conditions.
+	*addrOut = '\x00'
+	*localOut = '\x00'
+	*proxyOut = '\x00'
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+
+	s.mu.Lock()
+	lb := s.loopback
+	if lb == nil {
+		var err error
+		lb, err = startLoopback(s)
+		if err != nil {
+			s.mu.Unlock()
+			return s.recErr(err)
+		}
+		s.loopback = lb
+	}
+	s.mu.Unlock()
+
+	addr := lb.ln.Addr().String()
+	proxyCred, localAPICred := lb.creds()
+
+	out := unsafe.Slice((*byte)(unsafe.Pointer(addrOut)), addrLen)
+	n := copy(out, addr)
+	if n >= len(out) {
+		out[len(out)-1] = '\x00' // always NUL-terminate
+		return C.ERANGE
+	}
+	out[n] = '\x00'
+
+	if err := writeCred(proxyOut, proxyCred); err != nil {
+		return s.recErr(err)
+	}
+	if err := writeCred(localOut, localAPICred); err != nil {
+		return s.recErr(err)
+	}
+	return 0
+}
+
+//export TsnetLoopbackRotate
+func TsnetLoopbackRotate(sd C.int, proxyOut *C.char, localOut *C.char) C.int {
+	if proxyOut == nil {
+		panic("loopback_rotate passed nil proxy_cred_out")
+	} else if localOut == nil {
+		panic("loopback_rotate passed nil local_api_cred_out")
+	}
+	*localOut = '\x00'
+	*proxyOut = '\x00'
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+
+	s.mu.Lock()
+	lb := s.loopback
+	s.mu.Unlock()
+	if lb == nil {
+		return s.recErr(errors.New("libtailscale: loopback not started"))
+	}
+
+	proxyCred, localAPICred, err := lb.rotate()
+	if err != nil {
+		return s.recErr(err)
+	}
+	if err := writeCred(proxyOut, proxyCred); err != nil {
+		return s.recErr(err)
+	}
+	if err := writeCred(localOut, localAPICred); err != nil {
+		return s.recErr(err)
+	}
+	return 0
+}
+
+//export TsnetLoopbackStop
+func TsnetLoopbackStop(sd C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+
+	s.mu.Lock()
+	lb := s.loopback
+	s.loopback = nil
+	s.mu.Unlock()
+
+	if lb == nil {
+		return 0
+	}
+	return s.recErr(lb.close())
+}
@@ -0,0 +1,168 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/types/opt"
+)
+
+// netcheckTimeout bounds how long tailscale_netcheck waits for magicsock
+// to finish a report. netcheck itself gives up on STUN after 5 seconds.
+const netcheckTimeout = 15 * time.Second
+
+// netcheckReport is the JSON written by tailscale_netcheck.
+type netcheckReport struct {
+	UDP         bool // a UDP STUN round trip completed
+	IPv4        bool // an IPv4 STUN round trip completed
+	IPv6        bool // an IPv6 STUN round trip completed
+	IPv4CanSend bool // an IPv4 packet was able to be sent
+	IPv6CanSend bool // an IPv6 packet was able to be sent
+	OSHasIPv6   bool // could bind a socket to ::1
+
+	// MappingVariesByDestIP is whether the public address seen by STUN
+	// servers depends on which server is asked, i.e. a hard NAT.
+	// It is null if it could not be determined.
+	MappingVariesByDestIP opt.Bool
+
+	GlobalV4 string `json:",omitempty"` // public IPv4 "ip:port"
+	GlobalV6 string `json:",omitempty"` // public IPv6 "[ip]:port"
+
+	UPnP          opt.Bool
+	PMP           opt.Bool
+	PCP           opt.Bool
+	CaptivePortal opt.Bool
+
+	PreferredDERP     int    // region ID, or 0 if none
+	PreferredDERPCode string `json:",omitempty"`
+
+	// Regions holds the latency to every DERP region that answered,
+	// ordered by region ID.
+	Regions []netcheckRegion
+}
+
+type netcheckRegion struct {
+	RegionID         int
+	RegionCode       string
+	LatencySeconds   float64
+	V4LatencySeconds float64 `json:",omitempty"`
+	V6LatencySeconds float64 `json:",omitempty"`
+}
+
+// netcheck has the magicsock of s run a new netcheck and returns the
+// resulting report.
+//
+// The report is run by the node's own magicsock, over the same sockets
+// it uses for WireGuard traffic, so that it reflects the NAT mappings the
+// node's peers actually see.
+func (s *server) netcheck(ctx context.Context) (*netcheckReport, error) {
+	if _, err := s.netMap(ctx); err != nil {
+		// The DERP map, and so the list of STUN servers,
+		// comes from control.
+		return nil, err
+	}
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+	ms, ok := s.s.Sys().MagicSock.GetOK()
+	if !ok {
+		return nil, errNotRunning
+	}
+
+	start := time.Now()
+	ms.ReSTUN("libtailscale-netcheck")
+	var r *netcheck.Report
+	for {
+		if r = ms.GetLastNetcheckReport(ctx); r != nil && !r.Now.Before(start) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	dm, err := lc.CurrentDERPMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	regionCode := func(id int) string {
+		if r := dm.Regions[id]; r != nil {
+			return r.RegionCode
+		}
+		return ""
+	}
+	rep := &netcheckReport{
+		UDP:                   r.UDP,
+		IPv4:                  r.IPv4,
+		IPv6:                  r.IPv6,
+		IPv4CanSend:           r.IPv4CanSend,
+		IPv6CanSend:           r.IPv6CanSend,
+		OSHasIPv6:             r.OSHasIPv6,
+		MappingVariesByDestIP: r.MappingVariesByDestIP,
+		UPnP:                  r.UPnP,
+		PMP:                   r.PMP,
+		PCP:                   r.PCP,
+		CaptivePortal:         r.CaptivePortal,
+		PreferredDERP:         r.PreferredDERP,
+		PreferredDERPCode:     regionCode(r.PreferredDERP),
+		Regions:               []netcheckRegion{},
+	}
+	if r.GlobalV4.IsValid() {
+		rep.GlobalV4 = r.GlobalV4.String()
+	}
+	if r.GlobalV6.IsValid() {
+		rep.GlobalV6 = r.GlobalV6.String()
+	}
+	for id, d := range r.RegionLatency {
+		rep.Regions = append(rep.Regions, netcheckRegion{
+			RegionID:         id,
+			RegionCode:       regionCode(id),
+			LatencySeconds:   d.Seconds(),
+			V4LatencySeconds: r.RegionV4Latency[id].Seconds(),
+			V6LatencySeconds: r.RegionV6Latency[id].Seconds(),
+		})
+	}
+	slices.SortFunc(rep.Regions, func(a, b netcheckRegion) int { return a.RegionID - b.RegionID })
+	return rep, nil
+}
+
+//export TsnetNetcheck
+func TsnetNetcheck(sd C.int, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("netcheck", buf, buflen)
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, netcheckTimeout)
+	defer cancel()
+	rep, err := s.netcheck(ctx)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return s.recWaitErr(err)
+		}
+		s.recErr(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return C.ETIMEDOUT
+		}
+		return -1
+	}
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return s.recErr(err)
+	}
+	return writeOut(out, string(b))
+}
@@ -0,0 +1,328 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// findPeer returns the peer in nm that target, a Tailscale IP or a
+// MagicDNS name as accepted by tailscale_resolve, refers to.
+func findPeer(nm *netmap.NetworkMap, target string) (tailcfg.NodeView, bool) {
+	if ip, err := netip.ParseAddr(target); err == nil {
+		return nm.PeerByTailscaleIP(ip)
+	}
+	for _, fqdn := range tailnetFQDNs(nm, target) {
+		for _, p := range nm.Peers {
+			if strings.EqualFold(p.Name(), fqdn) {
+				return p, true
+			}
+		}
+	}
+	return tailcfg.NodeView{}, false
+}
+
+// peerOnline reports whether the node owning nm considers peer p online.
+//
+// As in ipnlocal, a node with client-side reachability ignores the
+// control server's idea of whether p is online.
+func peerOnline(nm *netmap.NetworkMap, p tailcfg.NodeView) bool {
+	return p.Online().Get() || nm.HasCap(tailcfg.NodeAttrClientSideReachability)
+}
+
+// waitPeer waits until target, a Tailscale IP or MagicDNS name, is an
+// online peer in the netmap of s.
+//
+// It returns ctx.Err() if ctx is done first, and errClosed if s is
+// closed first.
+func (s *server) waitPeer(ctx context.Context, target string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.ctx, cancel)
+	defer stop()
+
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+	if err != nil {
+		return s.waitErr(ctx, err)
+	}
+	defer w.Close()
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return s.waitErr(ctx, err)
+		}
+		if nm := n.NetMap; nm != nil {
+			if p, ok := findPeer(nm, target); ok && peerOnline(nm, p) {
+				return nil
+			}
+		}
+	}
+}
+
+// errClosed is returned by blocking calls interrupted by tailscale_close.
+var errClosed = errors.New("libtailscale: server closed")
+
+// waitErr returns the error for a blocking call on s that failed with
+// err, which is errClosed if s was closed and ctx.Err() if ctx is done.
+func (s *server) waitErr(ctx context.Context, err error) error {
+	switch {
+	case s.ctx.Err() != nil:
+		return errClosed
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	return err
+}
+
+// recWaitErr records the error of a blocking call on s like recErr,
+// returning ECANCELED if tailscale_close interrupted the call.
+func (s *server) recWaitErr(err error) C.int {
+	if err == nil {
+		return s.recErr(nil)
+	}
+	if err = s.waitErr(s.ctx, err); errors.Is(err, errClosed) {
+		s.recErr(err)
+		return C.ECANCELED
+	}
+	return s.recErr(err)
+}
+
+//export TsnetWaitPeer
+func TsnetWaitPeer(sd C.int, target *C.char, timeoutMillis C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	if target == nil || *target == 0 {
+		s.recErr(errors.New("libtailscale: empty peer name"))
+		return C.EINVAL
+	}
+	if timeoutMillis == 0 {
+		s.recErr(errors.New("libtailscale: wait_peer timeout must be positive, or negative to wait forever"))
+		return C.EINVAL
+	}
+	name := C.GoString(target)
+
+	ctx := context.Background()
+	if timeoutMillis > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+		defer cancel()
+	}
+	err := s.waitPeer(ctx, name)
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errClosed):
+		s.recErr(err)
+		return C.ECANCELED
+	case errors.Is(err, context.DeadlineExceeded):
+		s.recErr(fmt.Errorf("libtailscale: peer %q not online after %v", name, time.Duration(timeoutMillis)*time.Millisecond))
+		return C.ETIMEDOUT
+	}
+	return s.recErr(err)
+}
+
+// watchedPeer is the peer in the JSON events written by
+// tailscale_watch_peers.
+type watchedPeer struct {
+	ID           tailcfg.StableNodeID
+	Name         string   // MagicDNS name, without the trailing dot
+	HostName     string   // the hostname the peer reports
+	User         string   `json:",omitempty"` // login name of the owner, if not tagged
+	Tags         []string `json:",omitempty"`
+	TailscaleIPs []string
+	Online       bool
+}
+
+// peerEvent is a line written by tailscale_watch_peers.
+type peerEvent struct {
+	Event string // "added", "removed" or "changed"
+	Peer  watchedPeer
+}
+
+func newWatchedPeer(nm *netmap.NetworkMap, p tailcfg.NodeView) watchedPeer {
+	wp := watchedPeer{
+		ID:       p.StableID(),
+		Name:     strings.TrimSuffix(p.Name(), "."),
+		HostName: p.Hostinfo().Hostname(),
+		Tags:     p.Tags().AsSlice(),
+		Online:   peerOnline(nm, p),
+	}
+	if !p.IsTagged() {
+		if up, ok := nm.UserProfiles[p.User()]; ok {
+			wp.User = up.LoginName()
+		}
+	}
+	for _, a := range p.Addresses().All() {
+		if a.IsSingleIP() {
+			wp.TailscaleIPs = append(wp.TailscaleIPs, a.Addr().String())
+		}
+	}
+	return wp
+}
+
+// parsePeerFilter returns a function reporting whether a peer matches
+// filter, which is one of:
+//
+//	""            - every peer
+//	"tag:NAME"    - peers tagged tag:NAME
+//	"user:LOGIN"  - peers owned by the user with login name LOGIN
+//	anything else - a path.Match pattern for the MagicDNS short name
+//
+// Names are matched case-insensitively.
+func parsePeerFilter(filter string) (func(watchedPeer) bool, error) {
+	switch {
+	case filter == "":
+		return func(watchedPeer) bool { return true }, nil
+	case strings.HasPrefix(filter, "tag:"):
+		return func(p watchedPeer) bool {
+			return slices.ContainsFunc(p.Tags, func(t string) bool { return strings.EqualFold(t, filter) })
+		}, nil
+	case strings.HasPrefix(filter, "user:"):
+		login := strings.TrimPrefix(filter, "user:")
+		return func(p watchedPeer) bool { return strings.EqualFold(p.User, login) }, nil
+	}
+	pattern := strings.ToLower(filter)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("libtailscale: invalid peer filter %q: %w", filter, err)
+	}
+	return func(p watchedPeer) bool {
+		short, _, _ := strings.Cut(strings.ToLower(p.Name), ".")
+		ok, _ := path.Match(pattern, short)
+		return ok
+	}, nil
+}
+
+// diffPeers returns the events that turn the peers in old into those in
+// cur, ordered by peer name.
+func diffPeers(old, cur map[tailcfg.StableNodeID]watchedPeer) []peerEvent {
+	var evs []peerEvent
+	for id, p := range cur {
+		if o, ok := old[id]; !ok {
+			evs = append(evs, peerEvent{Event: "added", Peer: p})
+		} else if !reflect.DeepEqual(o, p) {
+			evs = append(evs, peerEvent{Event: "changed", Peer: p})
+		}
+	}
+	for id, p := range old {
+		if _, ok := cur[id]; !ok {
+			evs = append(evs, peerEvent{Event: "removed", Peer: p})
+		}
+	}
+	slices.SortFunc(evs, func(a, b peerEvent) int { return cmp.Compare(a.Peer.Name, b.Peer.Name) })
+	return evs
+}
+
+// watchPeers writes a JSON line to w for each peer event matching match,
+// until ctx is done or writing fails.
+func watchPeers(ctx context.Context, lc *local.Client, match func(watchedPeer) bool, w io.Writer) error {
+	bw, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+	if err != nil {
+		return err
+	}
+	defer bw.Close()
+	enc := json.NewEncoder(w)
+	peers := map[tailcfg.StableNodeID]watchedPeer{}
+	for {
+		n, err := bw.Next()
+		if err != nil {
+			return err
+		}
+		nm := n.NetMap
+		if nm == nil {
+			continue
+		}
+		cur := map[tailcfg.StableNodeID]watchedPeer{}
+		for _, p := range nm.Peers {
+			if wp := newWatchedPeer(nm, p); match(wp) {
+				cur[wp.ID] = wp
+			}
+		}
+		for _, ev := range diffPeers(peers, cur) {
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+		}
+		peers = cur
+	}
+}
+
+//export TsnetWatchPeers
+func TsnetWatchPeers(sd C.int, filter *C.char, fdOut *C.int) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	var f string
+	if filter != nil {
+		f = C.GoString(filter)
+	}
+	match, err := parsePeerFilter(f)
+	if err != nil {
+		s.recErr(err)
+		return C.EINVAL
+	}
+	lc, err := s.localClient()
+	if err != nil {
+		return s.recErr(err)
+	}
+
+	// As with tailscale_listener, C gets one side of a socketpair(2)
+	// so that it can poll for events.
+	fds, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return s.recErr(err)
+	}
+	if err := syscall.SetNonblock(fds[1], true); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return s.recErr(err)
+	}
+	sp := os.NewFile(uintptr(fds[1]), "watch_peers")
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	go func() {
+		// C never writes to its side, so reading sp returns once C
+		// has closed it.
+		var buf [1]byte
+		sp.Read(buf[:])
+		cancel()
+	}()
+	go func() {
+		defer sp.Close() // C reads EOF
+		defer cancel()
+		if err := watchPeers(ctx, lc, match, sp); err != nil && ctx.Err() == nil {
+			s.logf("libtailscale.watch_peers: %v", err)
+		}
+	}()
+
+	*fdOut = C.int(fds[0])
+	return 0
+}
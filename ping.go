@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// pingResult is the JSON written by tailscale_ping.
+type pingResult struct {
+	IP       string // ping destination
+	NodeIP   string // Tailscale IP of the node that answered
+	NodeName string // MagicDNS short name of the node that answered
+	Type     string // "disco", "TSMP" or "ICMP"
+
+	LatencySeconds float64
+
+	// Endpoint is the "ip:port" the ping was sent to if it went
+	// directly over UDP. It is not set for TSMP pings.
+	Endpoint string `json:",omitempty"`
+
+	// PeerRelay is "ip:port:vni:vni" if the ping went through a peer
+	// relay. It is not set for TSMP pings.
+	PeerRelay string `json:",omitempty"`
+
+	// DERP reports whether the ping went through a DERP relay, in
+	// which case DERPRegionID and DERPRegionCode name the region.
+	DERP           bool
+	DERPRegionID   int    `json:",omitempty"`
+	DERPRegionCode string `json:",omitempty"`
+}
+
+// parsePingType returns the tailcfg.PingType named by typ, which is
+// matched case-insensitively. The empty string means a disco ping.
+func parsePingType(typ string) (tailcfg.PingType, error) {
+	for _, pt := range []tailcfg.PingType{tailcfg.PingDisco, tailcfg.PingTSMP, tailcfg.PingICMP} {
+		if strings.EqualFold(typ, string(pt)) {
+			return pt, nil
+		}
+	}
+	if typ == "" {
+		return tailcfg.PingDisco, nil
+	}
+	return "", fmt.Errorf("libtailscale: unknown ping type %q, want disco, TSMP or ICMP", typ)
+}
+
+// ping sends a single ping of type pt to target, a tailnet name or IP.
+func (s *server) ping(ctx context.Context, target string, pt tailcfg.PingType) (*pingResult, error) {
+	addrs, err := s.resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+	// A node is pinged on one address. Prefer IPv4 as that is what
+	// the tailscale CLI does.
+	ip := addrs[0]
+	for _, a := range addrs {
+		if a.Is4() {
+			ip = a
+			break
+		}
+	}
+	pr, err := lc.Ping(ctx, ip, pt)
+	if err != nil {
+		return nil, err
+	}
+	if pr.Err != "" {
+		return nil, fmt.Errorf("libtailscale: ping %s: %s", target, pr.Err)
+	}
+	return &pingResult{
+		IP:             pr.IP,
+		NodeIP:         pr.NodeIP,
+		NodeName:       pr.NodeName,
+		Type:           string(pt),
+		LatencySeconds: pr.LatencySeconds,
+		Endpoint:       pr.Endpoint,
+		PeerRelay:      pr.PeerRelay,
+		DERP:           pr.DERPRegionID != 0,
+		DERPRegionID:   pr.DERPRegionID,
+		DERPRegionCode: pr.DERPRegionCode,
+	}, nil
+}
+
+//export TsnetPing
+func TsnetPing(sd C.int, target, typ *C.char, timeoutMillis C.int, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("ping", buf, buflen)
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	pt, err := parsePingType(C.GoString(typ))
+	if err != nil {
+		s.recErr(err)
+		return C.EINVAL
+	}
+	if timeoutMillis <= 0 {
+		s.recErr(errors.New("libtailscale: ping timeout must be positive"))
+		return C.EINVAL
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, time.Duration(timeoutMillis)*time.Millisecond)
+	defer cancel()
+	res, err := s.ping(ctx, C.GoString(target), pt)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return s.recWaitErr(err)
+		}
+		s.recErr(err)
+		if ctx.Err() != nil {
+			return C.ETIMEDOUT
+		}
+		return -1
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return s.recErr(err)
+	}
+	return writeOut(out, string(b))
+}
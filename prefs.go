@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+	"tailscale.com/util/dnsname"
+)
+
+// prefsJSON returns the current prefs of s as JSON, with private keys
+// removed.
+func (s *server) prefsJSON(ctx context.Context) ([]byte, error) {
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+	p, err := lc.GetPrefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(p)
+}
+
+// editPrefsJSON applies the ipn.MaskedPrefs in maskedJSON to s.
+//
+// Unknown fields are an error rather than being ignored, so that a
+// misspelt pref is not silently left unchanged.
+func (s *server) editPrefsJSON(ctx context.Context, maskedJSON string) error {
+	mp := new(ipn.MaskedPrefs)
+	dec := json.NewDecoder(strings.NewReader(maskedJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(mp); err != nil {
+		return fmt.Errorf("libtailscale: invalid masked prefs: %w", err)
+	}
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	_, err = lc.EditPrefs(ctx, mp)
+	return err
+}
+
+// setHostname changes the hostname of the running server s to name.
+//
+// If s is logged in, it waits for the control server to give the node
+// the MagicDNS name for name, returning an error if the control server
+// reports one, names the node something else, or does not rename it
+// within netMapTimeout. On error the previous hostname is restored.
+func (s *server) setHostname(ctx context.Context, name string) error {
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, netMapTimeout)
+	defer cancel()
+	w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState|ipn.NotifyInitialPrefs|ipn.NotifyInitialNetMap)
+	if err != nil {
+		return s.waitErr(ctx, err)
+	}
+	defer w.Close()
+
+	// The initial state, prefs and netmap may come in one notification
+	// or several, the state first.
+	var (
+		running  bool
+		oldHost  string
+		oldName  string // MagicDNS name
+		gotPrefs bool
+	)
+	for !gotPrefs || (running && oldName == "") {
+		n, err := w.Next()
+		if err != nil {
+			return s.waitErr(ctx, err)
+		}
+		if n.State != nil {
+			running = *n.State == ipn.Running
+		}
+		if n.Prefs != nil && n.Prefs.Valid() {
+			oldHost, gotPrefs = n.Prefs.Hostname(), true
+		}
+		if nm := n.NetMap; nm != nil && nm.SelfNode.Valid() {
+			oldName = nm.SelfNode.Name()
+		}
+	}
+
+	mp := &ipn.MaskedPrefs{HostnameSet: true}
+	mp.Hostname = name
+	if _, err := lc.EditPrefs(ctx, mp); err != nil {
+		return s.waitErr(ctx, err)
+	}
+	if !running {
+		// Control sees the new name when the node logs in.
+		return nil
+	}
+	label := dnsname.SanitizeHostname(name)
+	if strings.EqualFold(dnsname.FirstLabel(oldName), label) {
+		// The node already has the name, so no new netmap will come.
+		return nil
+	}
+	err = waitRenamed(w, oldName, label)
+	if err == nil {
+		return nil
+	}
+	err = s.waitErr(ctx, err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("libtailscale: control server did not rename the node to %q", name)
+	}
+
+	rctx, rcancel := context.WithTimeout(context.WithoutCancel(ctx), netMapTimeout)
+	defer rcancel()
+	mp.Hostname = oldHost
+	if _, rerr := lc.EditPrefs(rctx, mp); rerr != nil {
+		s.logf("libtailscale.set_hostname: restoring hostname %q: %v", oldHost, rerr)
+	}
+	return err
+}
+
+// waitRenamed waits for a netmap from w in which the node, whose
+// MagicDNS name was oldName, has a MagicDNS name whose first label is
+// label.
+func waitRenamed(w *local.IPNBusWatcher, oldName, label string) error {
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if n.ErrMessage != nil {
+			return fmt.Errorf("libtailscale: control server: %s", *n.ErrMessage)
+		}
+		nm := n.NetMap
+		if nm == nil || !nm.SelfNode.Valid() {
+			continue
+		}
+		newName := nm.SelfNode.Name()
+		switch {
+		case strings.EqualFold(dnsname.FirstLabel(newName), label):
+			return nil
+		case newName != oldName:
+			return fmt.Errorf("libtailscale: control server named the node %q rather than %q", strings.TrimSuffix(newName, "."), label)
+		}
+	}
+}
+
+//export TsnetPrefsGetJSON
+func TsnetPrefsGetJSON(sd C.int, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("prefs_get_json", buf, buflen)
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	b, err := s.prefsJSON(s.ctx)
+	if err != nil {
+		return s.recErr(err)
+	}
+	return writeOut(out, string(b))
+}
+
+//export TsnetPrefsEditJSON
+func TsnetPrefsEditJSON(sd C.int, maskedJSON *C.char) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	return s.recErr(s.editPrefsJSON(s.ctx, C.GoString(maskedJSON)))
+}
@@ -0,0 +1,201 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+
+	"tailscale.com/ipn"
+)
+
+// profile is an element of the JSON array written by
+// tailscale_profiles_list.
+type profile struct {
+	ID         ipn.ProfileID
+	Name       string // name of the user, e.g. "alice@example.com"
+	Tailnet    string `json:",omitempty"` // e.g. "example.com"
+	MagicDNS   string `json:",omitempty"` // MagicDNS suffix, e.g. "tailnet-1234.ts.net"
+	ControlURL string `json:",omitempty"`
+	Current    bool   `json:",omitempty"` // the profile in use
+}
+
+// listProfiles returns the login profiles of s.
+func (s *server) listProfiles(ctx context.Context) ([]profile, error) {
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+	current, all, err := lc.ProfileStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	profiles := []profile{}
+	for _, p := range all {
+		profiles = append(profiles, profile{
+			ID:         p.ID,
+			Name:       p.Name,
+			Tailnet:    p.NetworkProfile.DomainName,
+			MagicDNS:   p.NetworkProfile.MagicDNSName,
+			ControlURL: p.ControlURL,
+			Current:    p.ID == current.ID,
+		})
+	}
+	return profiles, nil
+}
+
+// switchProfile makes the login profile id current and waits for s to be
+// running on it.
+func (s *server) switchProfile(ctx context.Context, id ipn.ProfileID) error {
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	current, _, err := lc.ProfileStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if current.ID == id {
+		return nil
+	}
+	if err := lc.SwitchProfile(ctx, id); err != nil {
+		return err
+	}
+	s.closeForProfileChange()
+	return waitRunning(ctx, lc)
+}
+
+// addProfile logs s in to a new login profile with authKey, keeping the
+// current profile to switch back to later. If the login fails, s is
+// switched back to the current profile.
+//
+// The new profile uses the same control server and hostname as the
+// current one.
+func (s *server) addProfile(ctx context.Context, authKey string) error {
+	lc, err := s.localClient()
+	if err != nil {
+		return err
+	}
+	cur, err := lc.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	prefs := ipn.NewPrefs()
+	prefs.ControlURL = cur.ControlURL
+	prefs.Hostname = cur.Hostname
+	prefs.AdvertiseTags = cur.AdvertiseTags
+	prev, _, err := lc.ProfileStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if err := lc.SwitchToEmptyProfile(ctx); err != nil {
+		return err
+	}
+	s.closeForProfileChange()
+	s.mu.Lock()
+	oldLoginPrefs := s.loginPrefs
+	s.loginPrefs = prefs
+	s.mu.Unlock()
+	err = s.login(ctx, authKey)
+	if err == nil {
+		return nil
+	}
+
+	// Go back to the previous profile rather than leave s on an empty
+	// one, even if tailscale_close interrupted the login.
+	s.mu.Lock()
+	s.loginPrefs = oldLoginPrefs
+	s.mu.Unlock()
+	rctx, rcancel := context.WithTimeout(context.WithoutCancel(ctx), netMapTimeout)
+	defer rcancel()
+	rerr := lc.SwitchProfile(rctx, prev.ID)
+	if rerr == nil {
+		rerr = waitRunning(rctx, lc)
+	}
+	if rerr != nil {
+		s.logf("libtailscale.profile_add: switching back to profile %s: %v", prev.ID, rerr)
+	}
+	return err
+}
+
+// closeForProfileChange closes everything of s that belonged to the
+// previous login profile: its connections, which were to or from the old
+// profile's addresses, and listeners bound to one of those addresses.
+//
+// Listeners bound to a port only, like ":80", are kept and accept
+// connections on the new profile's addresses.
+func (s *server) closeForProfileChange() {
+	conns.mu.Lock()
+	for _, c := range conns.m {
+		if c.s == s.s && c.c != nil {
+			c.c.Close() // the copy goroutines in newConn clean up
+		}
+	}
+	conns.mu.Unlock()
+
+	listeners.mu.Lock()
+	for _, ln := range listeners.m {
+		if ln.s != s {
+			continue
+		}
+		host, _, err := net.SplitHostPort(ln.ln.Addr().String())
+		if err != nil {
+			continue
+		}
+		if ip, err := netip.ParseAddr(host); err == nil && !ip.IsUnspecified() {
+			ln.ln.Close() // the accept goroutine in TsnetListen cleans up
+		}
+	}
+	listeners.mu.Unlock()
+}
+
+//export TsnetProfilesList
+func TsnetProfilesList(sd C.int, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("profiles_list", buf, buflen)
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	profiles, err := s.listProfiles(s.ctx)
+	if err != nil {
+		return s.recErr(err)
+	}
+	b, err := json.Marshal(profiles)
+	if err != nil {
+		return s.recErr(err)
+	}
+	return writeOut(out, string(b))
+}
+
+//export TsnetProfileSwitch
+func TsnetProfileSwitch(sd C.int, id *C.char) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	if id == nil || *id == 0 {
+		return s.recErr(errors.New("libtailscale: empty profile ID"))
+	}
+	return s.recWaitErr(s.switchProfile(s.ctx, ipn.ProfileID(C.GoString(id))))
+}
+
+//export TsnetProfileAdd
+func TsnetProfileAdd(sd C.int, authKey *C.char) C.int {
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	var key string
+	if authKey != nil {
+		key = C.GoString(authKey)
+	}
+	return s.recWaitErr(s.addProfile(s.ctx, key))
+}
@@ -0,0 +1,380 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+//#include <netdb.h>
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/netmap"
+)
+
+// netMapTimeout bounds how long we wait for the IPN bus to deliver the
+// current netmap, which it normally does immediately.
+const netMapTimeout = 10 * time.Second
+
+// errNotRunning is returned when an operation needs the node to be in
+// the Running state.
+var errNotRunning = errors.New("libtailscale: tailscale is not running")
+
+// netMap returns the current netmap of s from the IPN bus.
+//
+// It returns errNotRunning if s is not in the Running state or does
+// not yet have a netmap.
+func (s *server) netMap(ctx context.Context) (*netmap.NetworkMap, error) {
+	if !s.started {
+		return nil, errNotRunning
+	}
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, netMapTimeout)
+	defer cancel()
+	w, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState|ipn.NotifyInitialNetMap)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	n, err := w.Next()
+	if err != nil {
+		return nil, err
+	}
+	if n.State == nil || *n.State != ipn.Running || n.NetMap == nil {
+		return nil, errNotRunning
+	}
+	return n.NetMap, nil
+}
+
+// tailnetFQDNs returns the fully qualified names, with a trailing dot,
+// that name may refer to on the tailnet described by nm.
+//
+// A name with no dots is a short name and is qualified with the MagicDNS
+// suffix and then each of the tailnet's search domains. Any other name is
+// taken to be fully qualified already.
+func tailnetFQDNs(nm *netmap.NetworkMap, name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+	if strings.Contains(name, ".") {
+		return []string{name + "."}
+	}
+	var fqdns []string
+	if suffix := nm.MagicDNSSuffix(); suffix != "" {
+		fqdns = append(fqdns, name+"."+suffix+".")
+	}
+	for _, d := range nm.DNS.Domains {
+		fqdn := name + "." + strings.ToLower(strings.Trim(d, ".")) + "."
+		if len(fqdns) == 0 || fqdns[0] != fqdn {
+			fqdns = append(fqdns, fqdn)
+		}
+	}
+	return fqdns
+}
+
+// resolveTailnet returns the addresses name resolves to on the tailnet
+// described by nm: the Tailscale IPs of a node with that MagicDNS name,
+// or the values of matching extra records in the tailnet DNS config.
+// It also returns the FQDN that matched, with a trailing dot.
+//
+// name may be a MagicDNS short name or a fully qualified name, with or
+// without a trailing dot. The first candidate FQDN that matches wins,
+// so that a short name resolves as it would through MagicDNS.
+func resolveTailnet(nm *netmap.NetworkMap, name string) (fqdn string, addrs []netip.Addr) {
+	for _, fqdn := range tailnetFQDNs(nm, name) {
+		var addrs []netip.Addr
+		addNode := func(n tailcfg.NodeView) {
+			if !n.Valid() || !strings.EqualFold(n.Name(), fqdn) {
+				return
+			}
+			for _, p := range n.Addresses().All() {
+				if p.IsSingleIP() {
+					addrs = append(addrs, p.Addr())
+				}
+			}
+		}
+		addNode(nm.SelfNode)
+		for _, p := range nm.Peers {
+			addNode(p)
+		}
+		for _, rec := range nm.DNS.ExtraRecords {
+			if rec.Type != "" && rec.Type != "A" && rec.Type != "AAAA" {
+				continue
+			}
+			if !strings.EqualFold(strings.TrimSuffix(rec.Name, ".")+".", fqdn) {
+				continue
+			}
+			if ip, err := netip.ParseAddr(rec.Value); err == nil {
+				addrs = append(addrs, ip)
+			}
+		}
+		if len(addrs) > 0 {
+			return fqdn, addrs
+		}
+	}
+	return "", nil
+}
+
+// resolve returns the tailnet addresses of name.
+//
+// An IP address literal resolves to itself.
+func (s *server) resolve(ctx context.Context, name string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(name); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+	nm, err := s.netMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, addrs := resolveTailnet(nm, name)
+	if len(addrs) == 0 {
+		return nil, &nxDomainError{name: name}
+	}
+	return addrs, nil
+}
+
+// lookupHost resolves name for tailscale_getaddrinfo, returning its
+// canonical name (without a trailing dot) and addresses.
+//
+// Names are resolved from the netmap as in resolve, and names under a
+// split DNS route of the tailnet are queried through the node's DNS
+// forwarder, which reaches the route's resolvers over the tailnet.
+// A name under the MagicDNS suffix or a split DNS route that does not
+// exist is an *nxDomainError.
+//
+// ok is false if name is not a tailnet name, or if the node is not
+// running yet, and should instead be looked up with the system resolver.
+func (s *server) lookupHost(ctx context.Context, name string) (canon string, addrs []netip.Addr, ok bool, err error) {
+	nm, err := s.netMap(ctx)
+	if errors.Is(err, errNotRunning) {
+		return "", nil, false, nil
+	} else if err != nil {
+		return "", nil, false, err
+	}
+	if fqdn, addrs := resolveTailnet(nm, name); len(addrs) > 0 {
+		return strings.TrimSuffix(fqdn, "."), addrs, true, nil
+	}
+
+	fqdn := strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	if !strings.Contains(fqdn[:len(fqdn)-1], ".") {
+		// Short names not on the tailnet, like "localhost", are
+		// left to the system.
+		return "", nil, false, nil
+	}
+	if suffix := nm.MagicDNSSuffix(); suffix != "" && dnsNameHasSuffix(fqdn, suffix) {
+		return "", nil, true, &nxDomainError{name: name}
+	}
+	route, resolvers := splitDNSRoute(nm, fqdn)
+	if route == "" {
+		return "", nil, false, nil
+	}
+	if len(resolvers) == 0 {
+		// A route with no resolvers is answered by MagicDNS
+		// alone, which we did above.
+		return "", nil, true, &nxDomainError{name: name}
+	}
+
+	lc, err := s.localClient()
+	if err != nil {
+		return "", nil, true, err
+	}
+	canon = strings.TrimSuffix(fqdn, ".")
+	nx := 0
+	for _, qtype := range []string{"A", "AAAA"} {
+		res, _, err := lc.QueryDNS(ctx, fqdn, qtype)
+		if err != nil {
+			return "", nil, true, err
+		}
+		rcanon, raddrs, err := parseDNSAnswers(res)
+		if errors.Is(err, errNXDomain) {
+			nx++
+			continue
+		} else if err != nil {
+			return "", nil, true, err
+		}
+		if rcanon != "" {
+			canon = rcanon
+		}
+		addrs = append(addrs, raddrs...)
+	}
+	if nx == 2 || len(addrs) == 0 {
+		return "", nil, true, &nxDomainError{name: name}
+	}
+	return canon, addrs, true, nil
+}
+
+// dnsNameHasSuffix reports whether fqdn, which has a trailing dot, is
+// suffix or a subdomain of it. suffix may or may not have a trailing dot.
+func dnsNameHasSuffix(fqdn, suffix string) bool {
+	suffix = strings.ToLower(strings.Trim(suffix, ".")) + "."
+	return fqdn == suffix || strings.HasSuffix(fqdn, "."+suffix)
+}
+
+// splitDNSRoute returns the most specific split DNS route in nm that
+// fqdn falls under, and its resolvers. It returns the empty string if
+// there is no such route.
+func splitDNSRoute(nm *netmap.NetworkMap, fqdn string) (route string, resolvers []*dnstype.Resolver) {
+	for r, rs := range nm.DNS.Routes {
+		if dnsNameHasSuffix(fqdn, r) && len(r) > len(route) {
+			route, resolvers = r, rs
+		}
+	}
+	return route, resolvers
+}
+
+// errNXDomain is returned by parseDNSAnswers for an NXDOMAIN response.
+var errNXDomain = errors.New("NXDOMAIN")
+
+// parseDNSAnswers parses a DNS response message, returning the A and
+// AAAA records it contains and the target of the last CNAME, if any.
+func parseDNSAnswers(msg []byte) (canon string, addrs []netip.Addr, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return "", nil, err
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return "", nil, errNXDomain
+	default:
+		return "", nil, fmt.Errorf("DNS query failed: %v", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", nil, err
+	}
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		} else if err != nil {
+			return "", nil, err
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return "", nil, err
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return "", nil, err
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		case dnsmessage.TypeCNAME:
+			r, err := p.CNAMEResource()
+			if err != nil {
+				return "", nil, err
+			}
+			canon = strings.TrimSuffix(r.CNAME.String(), ".")
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return canon, addrs, nil
+}
+
+// nxDomainError is returned when a name does not exist on the tailnet.
+type nxDomainError struct {
+	name string
+}
+
+func (e *nxDomainError) Error() string {
+	return fmt.Sprintf("libtailscale: no such host %q on the tailnet", e.name)
+}
+
+// eaiErr records err as the last error of s and returns the EAI_* code
+// that corresponds to it, which is EAI_FAIL for errors with no more
+// specific equivalent.
+func (s *server) eaiErr(err error) C.int {
+	s.recErr(err)
+	var nx *nxDomainError
+	switch {
+	case errors.Is(err, errNotRunning):
+		return C.EAI_AGAIN
+	case errors.As(err, &nx):
+		return C.EAI_NONAME
+	}
+	return C.EAI_FAIL
+}
+
+//export TsnetResolve
+func TsnetResolve(sd C.int, name *C.char, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("resolve", buf, buflen)
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	addrs, err := s.resolve(s.ctx, C.GoString(name))
+	if err != nil {
+		return s.eaiErr(err)
+	}
+	strs := make([]string, len(addrs))
+	for i, ip := range addrs {
+		strs[i] = ip.String()
+	}
+	return writeOut(out, strings.Join(strs, ","))
+}
+
+// lookupNotTailnet is returned by TsnetLookupHost for a name that
+// tailscale_getaddrinfo should resolve with the system resolver. It is
+// distinct from zero and from every EAI_* code on all platforms, and must
+// match TS_LOOKUP_NOT_TAILNET in tailscale.c.
+const lookupNotTailnet = math.MinInt32
+
+// TsnetLookupHost resolves name for tailscale_getaddrinfo. It returns
+// zero, an EAI_* code, or lookupNotTailnet. For EAI_SYSTEM it sets
+// *errnoOut to the errno value.
+//
+//export TsnetLookupHost
+func TsnetLookupHost(sd C.int, name *C.char, canonBuf *C.char, canonLen C.size_t, addrsBuf *C.char, addrsLen C.size_t, errnoOut *C.int) C.int {
+	canonOut := outBuf("lookup_host", canonBuf, canonLen)
+	addrsOut := outBuf("lookup_host", addrsBuf, addrsLen)
+	sysErr := func(errno C.int) C.int {
+		*errnoOut = errno
+		return C.EAI_SYSTEM
+	}
+
+	s := getServer(sd)
+	if s == nil {
+		return sysErr(C.EBADF)
+	}
+	canon, addrs, ok, err := s.lookupHost(s.ctx, C.GoString(name))
+	if err != nil {
+		return s.eaiErr(err)
+	}
+	if !ok {
+		return lookupNotTailnet
+	}
+	strs := make([]string, len(addrs))
+	for i, ip := range addrs {
+		strs[i] = ip.String()
+	}
+	if ret := writeOut(canonOut, canon); ret != 0 {
+		return sysErr(ret)
+	}
+	if ret := writeOut(addrsOut, strings.Join(strs, ",")); ret != 0 {
+		return sysErr(ret)
+	}
+	return 0
+}
@@ -44,6 +44,8 @@ class Tailscale
     attach_function :TsnetGetRemoteAddr, [:int, :int, :pointer, :size_t], :int
     attach_function :TsnetErrmsg, [:int, :pointer, :size_t], :int
     attach_function :TsnetLoopback, [:int, :pointer, :size_t, :pointer, :pointer], :int
+    attach_function :TsnetPrefsGetJSON, [:int, :pointer, :size_t], :int, blocking: true
+    attach_function :TsnetPrefsEditJSON, [:int, :string], :int, blocking: true
   end
 
   class ClosedError < StandardError
@@ -251,6 +253,26 @@ class Tailscale
     buf.read_string.split(",")
   end
 
+  # Get the preferences of this Tailscale node as a Hash, in the form of the
+  # LocalAPI's /localapi/v0/prefs endpoint. This method starts the node if it
+  # has not been started yet.
+  def prefs
+    assert_open
+    buf = FFI::MemoryPointer.new(:char, 64 * 1024)
+    Error.check(self, Libtailscale::TsnetPrefsGetJSON(@t, buf, buf.size))
+    JSON.parse(buf.read_string)
+  end
+
+  # Change some of the preferences of this Tailscale node. +masked_prefs+ is a
+  # Hash in the form of the Go type ipn.MaskedPrefs: each preference to change
+  # along with a matching "<Name>Set" => true entry, for example
+  # { "RouteAll" => true, "RouteAllSet" => true }. This method starts the node
+  # if it has not been started yet.
+  def edit_prefs(masked_prefs)
+    assert_open
+    Error.check(self, Libtailscale::TsnetPrefsEditJSON(@t, JSON.generate(masked_prefs)))
+  end
+
   # Dial a network address. +network+ is one of "tcp" or "udp". +addr+ is the
   # remote address to connect to. This method blocks until the connection is established.
   def dial(network, addr)
@@ -103,6 +103,14 @@ class TestTailscaleConfig < Minitest::Test
     assert_raises(Tailscale::ClosedError) { new_closed_ts.loopback }
   end
 
+  def test_closed_error_on_prefs
+    assert_raises(Tailscale::ClosedError) { new_closed_ts.prefs }
+  end
+
+  def test_closed_error_on_edit_prefs
+    assert_raises(Tailscale::ClosedError) { new_closed_ts.edit_prefs({}) }
+  end
+
   def test_error_class_attributes
     err = Tailscale::Error.new("test error", 42)
     assert_equal "test error", err.message
@@ -237,6 +245,20 @@ class TestTailscaleNetwork < Minitest::Test
       "expected a 100.x.y.z tailscale IPv4, got: #{ips}"
   end
 
+  def test_prefs
+    prefs = s1.prefs
+    assert_kind_of Hash, prefs
+    assert_equal true, prefs["WantRunning"]
+  end
+
+  def test_edit_prefs
+    was = s1.prefs["RouteAll"]
+    s1.edit_prefs({ "RouteAll" => !was, "RouteAllSet" => true })
+    assert_equal !was, s1.prefs["RouteAll"]
+  ensure
+    s1.edit_prefs({ "RouteAll" => was, "RouteAllSet" => true }) unless was.nil?
+  end
+
   def test_loopback
     addr, proxy_cred, local_cred = s1.loopback
     assert_match(/:\d+$/, addr)
@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+//#include <errno.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// errNoAddrs is returned when the node has no Tailscale IPs yet.
+var errNoAddrs = errors.New("libtailscale: no addresses assigned, is tailscale up?")
+
+// selfInfo is the JSON written by tailscale_self_json.
+type selfInfo struct {
+	ID             tailcfg.StableNodeID
+	Name           string // MagicDNS name, without the trailing dot
+	HostName       string
+	MagicDNSSuffix string
+	Tailnet        string
+	User           string     // login name of the owner
+	Tags           []string   `json:",omitempty"`
+	KeyExpiry      *time.Time `json:",omitempty"`
+	TailscaleIPs   []string
+}
+
+// self returns information about the node of s.
+//
+// It returns errNoAddrs if the node has no Tailscale IPs yet, including
+// when s has not been started.
+func (s *server) self(ctx context.Context) (*selfInfo, error) {
+	if !s.started {
+		return nil, errNoAddrs
+	}
+	lc, err := s.localClient()
+	if err != nil {
+		return nil, err
+	}
+	st, err := lc.Status(ctx) // StatusWithoutPeers leaves out User
+	if err != nil {
+		return nil, err
+	}
+	if st.Self == nil || len(st.TailscaleIPs) == 0 {
+		return nil, errNoAddrs
+	}
+	info := &selfInfo{
+		ID:             st.Self.ID,
+		Name:           strings.TrimSuffix(st.Self.DNSName, "."),
+		HostName:       st.Self.HostName,
+		MagicDNSSuffix: st.MagicDNSSuffix,
+		User:           st.User[st.Self.UserID].LoginName,
+		KeyExpiry:      st.Self.KeyExpiry,
+	}
+	if st.CurrentTailnet != nil {
+		info.Tailnet = st.CurrentTailnet.Name
+	}
+	if st.Self.Tags != nil {
+		info.Tags = st.Self.Tags.AsSlice()
+	}
+	for _, ip := range st.TailscaleIPs {
+		info.TailscaleIPs = append(info.TailscaleIPs, ip.String())
+	}
+	return info, nil
+}
+
+//export TsnetSelfJSON
+func TsnetSelfJSON(sd C.int, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("self_json", buf, buflen)
+
+	s := getServer(sd)
+	if s == nil {
+		return C.EBADF
+	}
+	info, err := s.self(s.ctx)
+	if err != nil {
+		s.recErr(err)
+		if errors.Is(err, errNoAddrs) {
+			return C.ENOTCONN
+		}
+		return -1
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return s.recErr(err)
+	}
+	return writeOut(out, string(b))
+}
@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/net/socks5"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// socks5UDPDialTimeout bounds each UDP dial of a SOCKS5 UDP
+	// ASSOCIATE. socks5.Server dials in the loop that reads the client's
+	// datagrams, so a slow dial holds up every datagram of the
+	// association.
+	socks5UDPDialTimeout = 2 * time.Second
+
+	// maxSOCKS5UDPTargets bounds the destinations of a SOCKS5 UDP
+	// ASSOCIATE. socks5.Server keeps a socket open for each until the
+	// association ends.
+	maxSOCKS5UDPTargets = 64
+)
+
+var errTooManyUDPTargets = errors.New("libtailscale: too many SOCKS5 UDP destinations")
+
+// serveSOCKSConn serves a single SOCKS5 client connection, which may use
+// the CONNECT or UDP ASSOCIATE commands.
+func (lb *loopback) serveSOCKSConn(c net.Conn) {
+	// A socks5.Server checks its password for every connection,
+	// so snapshot the current credential into a new one per
+	// connection rather than mutating a shared server.
+	proxyCred, _ := lb.creds()
+	s5s := &socks5.Server{
+		Logf:     logger.WithPrefix(lb.s.logf, "libtailscale.loopback: socks5: "),
+		Dialer:   lb.socks5Dialer(),
+		Username: "tsnet",
+		Password: proxyCred,
+	}
+	s5s.Serve(&oneConnListener{c: c})
+}
+
+// socks5Dialer returns the Dialer for the socks5.Server of one client
+// connection, which dials the tailnet and bounds the UDP destinations of
+// the connection's UDP ASSOCIATE.
+func (lb *loopback) socks5Dialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var mu sync.Mutex
+	udpTargets := 0
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "udp" {
+			return lb.s.s.Dial(ctx, network, addr)
+		}
+		mu.Lock()
+		if udpTargets >= maxSOCKS5UDPTargets {
+			mu.Unlock()
+			return nil, errTooManyUDPTargets
+		}
+		udpTargets++
+		mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(ctx, socks5UDPDialTimeout)
+		defer cancel()
+		c, err := lb.s.s.Dial(ctx, network, addr)
+		if err != nil {
+			mu.Lock()
+			udpTargets--
+			mu.Unlock()
+		}
+		return c, err
+	}
+}
+
+// oneConnListener is a net.Listener that returns c from its first
+// Accept and net.ErrClosed thereafter.
+type oneConnListener struct {
+	mu sync.Mutex
+	c  net.Conn
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.c
+	if c == nil {
+		return nil, net.ErrClosed
+	}
+	l.c = nil
+	return c, nil
+}
+
+func (l *oneConnListener) Close() error { return nil }
+
+func (l *oneConnListener) Addr() net.Addr { return dummyAddr("oneconn") }
+
+type dummyAddr string
+
+func (a dummyAddr) Network() string { return string(a) }
+func (a dummyAddr) String() string  { return string(a) }
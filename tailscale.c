@@ -2,8 +2,13 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 #include "tailscale.h"
+#include <errno.h>
+#include <limits.h>
+#include <netdb.h>
 #include <sys/socket.h>
 #include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
 #include <unistd.h>
 
 // Functions exported by Go.
@@ -11,8 +16,21 @@ extern int TsnetNewServer();
 extern int TsnetStart(int sd);
 extern int TsnetUp(int sd);
 extern int TsnetClose(int sd);
+extern int TsnetWaitPeer(int sd, char* target, int timeoutMillis);
+extern int TsnetWatchPeers(int sd, char* filter, int* fdOut);
+extern int TsnetLogout(int sd);
+extern int TsnetReauth(int sd, char* authKey);
+extern int TsnetProfilesList(int sd, char* buf, size_t buflen);
+extern int TsnetProfileSwitch(int sd, char* id);
+extern int TsnetProfileAdd(int sd, char* authKey);
 extern int TsnetErrmsg(int sd, char* buf, size_t buflen);
 extern int TsnetDial(int sd, char* net, char* addr, int* connOut);
+extern int TsnetDialTimeout(int sd, char* net, char* addr, int timeoutMillis, int* connOut);
+extern int TsnetDialAsync(int sd, char* net, char* addr, int* connOut);
+extern int TsnetConnError(int conn);
+extern int TsnetDialTag(int sd, char* net, char* tag, int port, char* policy, int* connOut);
+extern int TsnetDialVerified(int sd, char* net, char* addr, char* expected, int* connOut);
+extern int TsnetDialTLS(int sd, char* addr, int* connOut);
 extern int TsnetSetDir(int sd, char* str);
 extern int TsnetSetHostname(int sd, char* str);
 extern int TsnetSetAuthKey(int sd, char* str);
@@ -20,10 +38,32 @@ extern int TsnetSetControlURL(int sd, char* str);
 extern int TsnetSetEphemeral(int sd, int ephemeral);
 extern int TsnetSetLogFD(int sd, int fd);
 extern int TsnetGetIps(int sd, char *buf, size_t buflen);
+extern int TsnetSelfJSON(int sd, char* buf, size_t buflen);
+extern int TsnetResolve(int sd, char* name, char* buf, size_t buflen);
+extern int TsnetLookupHost(int sd, char* name, char* canonBuf, size_t canonLen, char* addrsBuf, size_t addrsLen, int* errnoOut);
+
+// TS_LOOKUP_NOT_TAILNET is returned by TsnetLookupHost for names that
+// are resolved with the system resolver. It must match lookupNotTailnet
+// in resolve.go.
+#define TS_LOOKUP_NOT_TAILNET INT_MIN
 extern int TsnetGetRemoteAddr(int listener, int conn, char *buf, size_t buflen);
 extern int TsnetListen(int sd, char* net, char* addr, int* listenerOut);
 extern int TsnetAccept(int ld, int* connOut);
+extern int TsnetAcceptFlags(int ld, int flags, int* connOut);
+extern int TsnetAcceptTimeout(int ld, int timeoutMillis, int* connOut);
+extern int TsnetListenerClose(int ld);
+extern int TsnetListenerAddr(int ld, char* buf, size_t buflen);
 extern int TsnetLoopback(int sd, char* addrOut, size_t addrLen, char* proxyOut, char* localOut);
+extern int TsnetLoopbackRotate(int sd, char* proxyOut, char* localOut);
+extern int TsnetLoopbackStop(int sd);
+extern int TsnetDNSServer(int sd, char* listenAddr);
+extern int TsnetPing(int sd, char* target, char* type, int timeoutMillis, char* buf, size_t buflen);
+extern int TsnetNetcheck(int sd, char* buf, size_t buflen);
+extern int TsnetSetExitNode(int sd, char* node, int allowLAN);
+extern int TsnetListExitNodes(int sd, char* buf, size_t buflen);
+extern int TsnetSuggestExitNode(int sd, char* buf, size_t buflen);
+extern int TsnetPrefsGetJSON(int sd, char* buf, size_t buflen);
+extern int TsnetPrefsEditJSON(int sd, char* maskedJSON);
 extern int TsnetEnableFunnelToLocalhostPlaintextHttp1(int sd, int localhostPort);
 
 tailscale tailscale_new() {
@@ -38,14 +78,66 @@ int tailscale_up(tailscale sd) {
 	return TsnetUp(sd);
 }
 
+int tailscale_wait_peer(tailscale sd, const char* name_or_ip, int timeout_ms) {
+	return TsnetWaitPeer(sd, (char*)name_or_ip, timeout_ms);
+}
+
+int tailscale_watch_peers(tailscale sd, const char* filter, int* fd_out) {
+	return TsnetWatchPeers(sd, (char*)filter, fd_out);
+}
+
 int tailscale_close(tailscale sd) {
 	return TsnetClose(sd);
 }
 
+int tailscale_logout(tailscale sd) {
+	return TsnetLogout(sd);
+}
+
+int tailscale_reauth(tailscale sd, const char* authkey) {
+	return TsnetReauth(sd, (char*)authkey);
+}
+
+int tailscale_profiles_list(tailscale sd, char* buf, size_t buflen) {
+	return TsnetProfilesList(sd, buf, buflen);
+}
+
+int tailscale_profile_switch(tailscale sd, const char* profile_id) {
+	return TsnetProfileSwitch(sd, (char*)profile_id);
+}
+
+int tailscale_profile_add(tailscale sd, const char* authkey) {
+	return TsnetProfileAdd(sd, (char*)authkey);
+}
+
 int tailscale_dial(tailscale sd, const char* network, const char* addr, tailscale_conn* conn_out) {
 	return TsnetDial(sd, (char*)network, (char*)addr, (int*)conn_out);
 }
 
+int tailscale_dial_timeout(tailscale sd, const char* network, const char* addr, int timeout_ms, tailscale_conn* conn_out) {
+	return TsnetDialTimeout(sd, (char*)network, (char*)addr, timeout_ms, (int*)conn_out);
+}
+
+int tailscale_dial_async(tailscale sd, const char* network, const char* addr, tailscale_conn* conn_out) {
+	return TsnetDialAsync(sd, (char*)network, (char*)addr, (int*)conn_out);
+}
+
+int tailscale_conn_error(tailscale_conn conn) {
+	return TsnetConnError(conn);
+}
+
+int tailscale_dial_tag(tailscale sd, const char* network, const char* tag, int port, const char* policy, tailscale_conn* conn_out) {
+	return TsnetDialTag(sd, (char*)network, (char*)tag, port, (char*)policy, (int*)conn_out);
+}
+
+int tailscale_dial_verified(tailscale sd, const char* network, const char* addr, const char* expected, tailscale_conn* conn_out) {
+	return TsnetDialVerified(sd, (char*)network, (char*)addr, (char*)expected, (int*)conn_out);
+}
+
+int tailscale_dial_tls(tailscale sd, const char* addr, tailscale_conn* conn_out) {
+	return TsnetDialTLS(sd, (char*)addr, (int*)conn_out);
+}
+
 int tailscale_listen(tailscale sd, const char* network, const char* addr, tailscale_listener* listener_out) {
 	return TsnetListen(sd, (char*)network, (char*)addr, (int*)listener_out);
 }
@@ -54,6 +146,22 @@ int tailscale_accept(tailscale_listener ld, tailscale_conn* conn_out) {
 	return TsnetAccept(ld, (int*)conn_out);
 }
 
+int tailscale_accept_flags(tailscale_listener ld, int flags, tailscale_conn* conn_out) {
+	return TsnetAcceptFlags(ld, flags, (int*)conn_out);
+}
+
+int tailscale_accept_timeout(tailscale_listener ld, int timeout_ms, tailscale_conn* conn_out) {
+	return TsnetAcceptTimeout(ld, timeout_ms, (int*)conn_out);
+}
+
+int tailscale_listener_close(tailscale_listener ld) {
+	return TsnetListenerClose(ld);
+}
+
+int tailscale_listener_addr(tailscale_listener ld, char* buf, size_t buflen) {
+	return TsnetListenerAddr(ld, buf, buflen);
+}
+
 int tailscale_getremoteaddr(tailscale_listener l, tailscale_conn conn, char* buf, size_t buflen) {
 	return TsnetGetRemoteAddr(l, conn, buf, buflen);
 }
@@ -62,6 +170,126 @@ int tailscale_getips(tailscale sd, char* buf, size_t buflen) {
 	return TsnetGetIps(sd, buf, buflen);
 }
 
+int tailscale_self_json(tailscale sd, char* buf, size_t buflen) {
+	return TsnetSelfJSON(sd, buf, buflen);
+}
+
+int tailscale_resolve(tailscale sd, const char* name, char* buf, size_t buflen) {
+	return TsnetResolve(sd, (char*)name, buf, buflen);
+}
+
+// ts_copy_addrinfo appends copies of the entries in src to the list ending
+// at *tail, so that every list returned by tailscale_getaddrinfo is
+// allocated the same way and can be freed by tailscale_freeaddrinfo.
+static int ts_copy_addrinfo(const struct addrinfo* src, struct addrinfo*** tail) {
+	for (; src != NULL; src = src->ai_next) {
+		struct addrinfo* ai = calloc(1, sizeof(*ai) + src->ai_addrlen);
+		if (ai == NULL) {
+			return EAI_MEMORY;
+		}
+		*ai = *src;
+		ai->ai_next = NULL;
+		ai->ai_canonname = NULL;
+		ai->ai_addr = (struct sockaddr*)(ai + 1);
+		memcpy(ai->ai_addr, src->ai_addr, src->ai_addrlen);
+		**tail = ai;
+		*tail = &ai->ai_next;
+		if (src->ai_canonname != NULL && (ai->ai_canonname = strdup(src->ai_canonname)) == NULL) {
+			return EAI_MEMORY;
+		}
+	}
+	return 0;
+}
+
+// ts_sys_getaddrinfo calls the system getaddrinfo and copies the result.
+static int ts_sys_getaddrinfo(const char* node, const char* service, const struct addrinfo* hints, struct addrinfo*** tail) {
+	struct addrinfo* res = NULL;
+	int ret = getaddrinfo(node, service, hints, &res);
+	if (ret != 0) {
+		return ret;
+	}
+	ret = ts_copy_addrinfo(res, tail);
+	freeaddrinfo(res);
+	return ret;
+}
+
+int tailscale_getaddrinfo(tailscale sd, const char* node, const char* service, const struct addrinfo* hints, struct addrinfo** res) {
+	struct addrinfo* head = NULL;
+	struct addrinfo** tail = &head;
+	int flags = hints != NULL ? hints->ai_flags : 0;
+	int ret;
+
+	if (node == NULL || (flags & AI_NUMERICHOST) != 0) {
+		ret = ts_sys_getaddrinfo(node, service, hints, &tail);
+		goto out;
+	}
+
+	char canon[1025]; // NI_MAXHOST
+	char addrs[4096];
+	int lookup_errno = 0;
+	ret = TsnetLookupHost(sd, (char*)node, canon, sizeof(canon), addrs, sizeof(addrs), &lookup_errno);
+	switch (ret) {
+	case 0:
+		break;
+	case TS_LOOKUP_NOT_TAILNET:
+		ret = ts_sys_getaddrinfo(node, service, hints, &tail);
+		goto out;
+	case EAI_SYSTEM:
+		errno = lookup_errno;
+		goto out;
+	default:
+		goto out; // an EAI_* code
+	}
+
+	// Let the system getaddrinfo apply hints and service to each of the
+	// tailnet addresses in turn, as numeric hosts. AI_ADDRCONFIG is
+	// dropped as the host's own interfaces say nothing about which
+	// address families are reachable over the tailnet.
+	struct addrinfo numeric_hints = {0};
+	if (hints != NULL) {
+		numeric_hints = *hints;
+	}
+	numeric_hints.ai_flags = (flags | AI_NUMERICHOST) & ~(AI_ADDRCONFIG | AI_CANONNAME);
+
+	int last_err = EAI_NONAME;
+	char* save = NULL;
+	for (char* ip = strtok_r(addrs, ",", &save); ip != NULL; ip = strtok_r(NULL, ",", &save)) {
+		int err = ts_sys_getaddrinfo(ip, service, &numeric_hints, &tail);
+		if (err == EAI_MEMORY || err == EAI_SERVICE || err == EAI_SOCKTYPE || err == EAI_BADFLAGS) {
+			ret = err;
+			goto out;
+		} else if (err != 0) {
+			last_err = err; // e.g. an IPv6 address with AF_INET hints
+		}
+	}
+	if (head == NULL) {
+		ret = last_err;
+		goto out;
+	}
+	if ((flags & AI_CANONNAME) != 0 && (head->ai_canonname = strdup(canon)) == NULL) {
+		ret = EAI_MEMORY;
+		goto out;
+	}
+	ret = 0;
+
+out:
+	if (ret != 0) {
+		tailscale_freeaddrinfo(head);
+		return ret;
+	}
+	*res = head;
+	return 0;
+}
+
+void tailscale_freeaddrinfo(struct addrinfo* res) {
+	while (res != NULL) {
+		struct addrinfo* next = res->ai_next;
+		free(res->ai_canonname);
+		free(res);
+		res = next;
+	}
+}
+
 int tailscale_set_dir(tailscale sd, const char* dir) {
 	return TsnetSetDir(sd, (char*)dir);
 }
@@ -85,6 +313,46 @@ int tailscale_loopback(tailscale sd, char* addr_out, size_t addrlen, char* proxy
 	return TsnetLoopback(sd, addr_out, addrlen, proxy_cred_out, local_api_cred_out);
 }
 
+int tailscale_loopback_rotate(tailscale sd, char* proxy_cred_out, char* local_api_cred_out) {
+	return TsnetLoopbackRotate(sd, proxy_cred_out, local_api_cred_out);
+}
+
+int tailscale_loopback_stop(tailscale sd) {
+	return TsnetLoopbackStop(sd);
+}
+
+int tailscale_dns_server(tailscale sd, const char* listen_addr) {
+	return TsnetDNSServer(sd, (char*)listen_addr);
+}
+
+int tailscale_ping(tailscale sd, const char* target, const char* type, int timeout_ms, char* buf, size_t buflen) {
+	return TsnetPing(sd, (char*)target, (char*)type, timeout_ms, buf, buflen);
+}
+
+int tailscale_netcheck(tailscale sd, char* buf, size_t buflen) {
+	return TsnetNetcheck(sd, buf, buflen);
+}
+
+int tailscale_set_exit_node(tailscale sd, const char* node, int allow_lan) {
+	return TsnetSetExitNode(sd, (char*)node, allow_lan);
+}
+
+int tailscale_list_exit_nodes(tailscale sd, char* buf, size_t buflen) {
+	return TsnetListExitNodes(sd, buf, buflen);
+}
+
+int tailscale_suggest_exit_node(tailscale sd, char* buf, size_t buflen) {
+	return TsnetSuggestExitNode(sd, buf, buflen);
+}
+
+int tailscale_prefs_get_json(tailscale sd, char* buf, size_t buflen) {
+	return TsnetPrefsGetJSON(sd, buf, buflen);
+}
+
+int tailscale_prefs_edit_json(tailscale sd, const char* masked_prefs_json) {
+	return TsnetPrefsEditJSON(sd, (char*)masked_prefs_json);
+}
+
 int tailscale_errmsg(tailscale sd, char* buf, size_t buflen) {
 	return TsnetErrmsg(sd, buf, buflen);
 }
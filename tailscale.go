@@ -9,18 +9,24 @@ import "C"
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
+	"net/netip"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
+	"tailscale.com/client/local"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
 	"tailscale.com/tsnet"
@@ -40,6 +46,24 @@ type server struct {
 	s       *tsnet.Server
 	lastErr string
 	started bool
+
+	// ctx is canceled by tailscale_close, to interrupt blocking calls.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	loopback    *loopback // non-nil after tailscale_loopback
+	dnsServers  []*dnsServer
+	loginPrefs  *ipn.Prefs     // non-nil after tailscale_logout, until logged in again
+	dialTagNext map[string]int // next round-robin index by tag, for tailscale_dial_tag
+	// portsPicked holds the ports listen picked for port 0 listeners
+	// that are not in listeners yet.
+	portsPicked map[int]bool
+
+	// tlsRootCAs is the set of root certificates tailscale_dial_tls
+	// trusts. If nil, the system roots are used. Tests set it to their
+	// own CA.
+	tlsRootCAs *x509.CertPool
 }
 
 func getServer(sd C.int) *server {
@@ -58,8 +82,38 @@ type listener struct {
 	s  *server
 	ln net.Listener
 	fd int // go side fd of socketpair sent to C
-	mu sync.Mutex
-	m  map[C.int]net.Addr //maps fds to remote addresses for lookup
+	// done is closed once the accept goroutine has exited and closed
+	// fd.
+	done chan struct{}
+	mu   sync.Mutex
+	m    map[C.int]net.Addr //maps fds to remote addresses for lookup
+
+	fdMu     sync.Mutex
+	fdClosed bool
+}
+
+// closeFd closes fd, once however many times it is called.
+//
+// If fdC is closed on the C side, then we end up calling into cleanup
+// twice. Be careful to avoid syscall.Close twice as the FD may have been
+// reallocated.
+func (ln *listener) closeFd() {
+	ln.fdMu.Lock()
+	defer ln.fdMu.Unlock()
+	if !ln.fdClosed {
+		syscall.Close(ln.fd)
+		ln.fdClosed = true
+	}
+}
+
+// shutdownFd shuts fd down, unless it is closed, waking an accept
+// goroutine blocked sending a conn to a C side that stopped accepting.
+func (ln *listener) shutdownFd() {
+	ln.fdMu.Lock()
+	defer ln.fdMu.Unlock()
+	if !ln.fdClosed {
+		syscall.Shutdown(ln.fd, syscall.SHUT_RDWR)
+	}
 }
 
 // conns tracks all the pipe(2)s allocated via tsnet_dial.
@@ -70,10 +124,16 @@ var conns struct {
 
 type conn struct {
 	s *tsnet.Server
-	c net.Conn
+	c net.Conn // nil until a tailscale_dial_async dial succeeds
 	r *os.File // r is the local socket to the C client
 }
 
+func (s *server) logf(format string, args ...any) {
+	if s.s.Logf != nil {
+		s.s.Logf(format, args...)
+	}
+}
+
 func (s *server) recErr(err error) C.int {
 	if err == nil {
 		s.lastErr = ""
@@ -83,6 +143,54 @@ func (s *server) recErr(err error) C.int {
 	return -1
 }
 
+// start starts s if it has not been started yet. Calls that then block,
+// like dials, use it first so that a tailscale_close interrupting them
+// knows to close s.
+func (s *server) start() error {
+	if err := s.s.Start(); err != nil {
+		return err
+	}
+	s.started = true
+	return nil
+}
+
+// localClient returns the LocalAPI client of s, starting s if it has not
+// been started yet.
+func (s *server) localClient() (*local.Client, error) {
+	lc, err := s.s.LocalClient() // calls Start
+	if err != nil {
+		return nil, err
+	}
+	s.started = true
+	return lc, nil
+}
+
+// outBuf returns the C buffer buf as a slice holding the empty string, so
+// that it is NUL-terminated however the caller returns. fn names the C
+// function for the panic if buf is nil or has no room for the NUL.
+func outBuf(fn string, buf *C.char, buflen C.size_t) []byte {
+	if buf == nil {
+		panic(fn + " passed nil buf")
+	} else if buflen == 0 {
+		panic(fn + " passed buflen of 0")
+	}
+	out := unsafe.Slice((*byte)(unsafe.Pointer(buf)), buflen)
+	out[0] = '\x00'
+	return out
+}
+
+// writeOut copies str into out as a NUL-terminated string. It returns
+// ERANGE, leaving a truncated copy in out, if str does not fit.
+func writeOut(out []byte, str string) C.int {
+	n := copy(out, str)
+	if n >= len(out) {
+		out[len(out)-1] = '\x00' // always NUL-terminate
+		return C.ERANGE
+	}
+	out[n] = '\x00'
+	return 0
+}
+
 //export TsnetNewServer
 func TsnetNewServer() C.int {
 	servers.mu.Lock()
@@ -98,6 +206,7 @@ func TsnetNewServer() C.int {
 	sd := servers.next
 	servers.next++
 	s := &server{s: &tsnet.Server{}}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	servers.m[sd] = s
 	return (C.int)(sd)
 }
@@ -108,11 +217,7 @@ func TsnetStart(sd C.int) C.int {
 	if s == nil {
 		return C.EBADF
 	}
-	err := s.s.Start()
-	if err == nil {
-		s.started = true
-	}
-	return s.recErr(err)
+	return s.recErr(s.start())
 }
 
 //export TsnetUp
@@ -121,11 +226,20 @@ func TsnetUp(sd C.int) C.int {
 	if s == nil {
 		return C.EBADF
 	}
-	_, err := s.s.Up(context.Background()) // cancellation is via TsnetClose
-	if err == nil {
-		s.started = true
+	s.mu.Lock()
+	loggedOut := s.loginPrefs != nil
+	s.mu.Unlock()
+	if loggedOut {
+		// tsnet.Server.Up only logs in when it starts the server.
+		if err := s.login(s.ctx, s.s.AuthKey); err != nil {
+			return s.recWaitErr(err)
+		}
+	}
+	if err := s.start(); err != nil {
+		return s.recErr(err)
 	}
-	return s.recErr(err)
+	_, err := s.s.Up(s.ctx) // canceled by tailscale_close
+	return s.recWaitErr(err)
 }
 
 //export TsnetClose
@@ -141,8 +255,18 @@ func TsnetClose(sd C.int) C.int {
 		return C.EBADF
 	}
 
-	// TODO: cancel Up
 	// TODO: close related listeners / conns.
+	s.cancel() // interrupts blocking calls, like tailscale_up
+	s.mu.Lock()
+	if s.loopback != nil {
+		s.loopback.close()
+		s.loopback = nil
+	}
+	for _, d := range s.dnsServers {
+		d.close()
+	}
+	s.dnsServers = nil
+	s.mu.Unlock()
 	if !s.started {
 		// Server was never started, nothing to close.
 		return 0
@@ -174,8 +298,22 @@ func TsnetGetIps(sd C.int, buf *C.char, buflen C.size_t) C.int {
 		return C.EBADF
 	}
 
+	if !s.started {
+		out[0] = '\x00'
+		return C.ENOTCONN
+	}
+	var ips []string
 	ip4, ip6 := s.s.TailscaleIPs()
-	joined := strings.Join([]string{ip4.String(), ip6.String()}, ",")
+	for _, ip := range []netip.Addr{ip4, ip6} {
+		if ip.IsValid() {
+			ips = append(ips, ip.String())
+		}
+	}
+	if len(ips) == 0 {
+		out[0] = '\x00'
+		return C.ENOTCONN
+	}
+	joined := strings.Join(ips, ",")
 	n := copy(out, joined)
 	if n >= len(out) {
 		out[len(out)-1] = '\x00' // always NUL-terminate
@@ -211,6 +349,86 @@ func TsnetErrmsg(sd C.int, buf *C.char, buflen C.size_t) C.int {
 	return 0
 }
 
+// The dynamic port range, from which listen picks ports for port 0.
+const dynamicPortMin, dynamicPortMax = 49152, 65535
+
+// listen is s.s.Listen, except that if addr has port 0 it listens on an
+// unused port in the dynamic range, as tsnet takes port 0 literally.
+//
+// The caller must call release once ln is in listeners, or it failed to
+// add it, so that concurrent calls do not pick the same port.
+func (s *server) listen(network, addr string) (ln net.Listener, release func(), err error) {
+	release = func() {}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != "0" {
+		ln, err = s.s.Listen(network, addr)
+		return ln, release, err
+	}
+
+	start := dynamicPortMin + rand.IntN(dynamicPortMax-dynamicPortMin+1)
+	s.mu.Lock()
+	used := s.listenerPorts()
+	for p := range s.portsPicked {
+		used[p] = true
+	}
+	p, ok := freePort(used, start)
+	if ok {
+		if s.portsPicked == nil {
+			s.portsPicked = map[int]bool{}
+		}
+		s.portsPicked[p] = true
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("libtailscale: no free %s port to listen on", network)
+	}
+
+	release = func() {
+		s.mu.Lock()
+		delete(s.portsPicked, p)
+		s.mu.Unlock()
+	}
+	ln, err = s.s.Listen(network, net.JoinHostPort(host, strconv.Itoa(p)))
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return ln, release, nil
+}
+
+// listenerPorts returns the ports of s's open listeners.
+func (s *server) listenerPorts() map[int]bool {
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+	used := map[int]bool{}
+	for _, ln := range listeners.m {
+		if ln.s != s {
+			continue
+		}
+		_, port, err := net.SplitHostPort(ln.ln.Addr().String())
+		if err != nil {
+			continue
+		}
+		if p, err := strconv.Atoi(port); err == nil {
+			used[p] = true
+		}
+	}
+	return used
+}
+
+// freePort returns the first port in the dynamic range at or after start,
+// wrapping around, that is not in used. It reports false if there is none.
+func freePort(used map[int]bool, start int) (int, bool) {
+	n := dynamicPortMax - dynamicPortMin + 1
+	for i := range n {
+		p := dynamicPortMin + (start-dynamicPortMin+i)%n
+		if !used[p] {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
 //export TsnetListen
 func TsnetListen(sd C.int, network, addr *C.char, listenerOut *C.int) C.int {
 	s := getServer(sd)
@@ -218,10 +436,11 @@ func TsnetListen(sd C.int, network, addr *C.char, listenerOut *C.int) C.int {
 		return C.EBADF
 	}
 
-	ln, err := s.s.Listen(C.GoString(network), C.GoString(addr))
+	ln, release, err := s.listen(C.GoString(network), C.GoString(addr))
 	if err != nil {
 		return s.recErr(err)
 	}
+	defer release()
 	s.started = true
 
 	// The tailscale_listener we return to C is one side of a socketpair(2).
@@ -240,21 +459,24 @@ func TsnetListen(sd C.int, network, addr *C.char, listenerOut *C.int) C.int {
 	if listeners.m == nil {
 		listeners.m = map[C.int]*listener{}
 	}
-	listener := &listener{s: s, ln: ln, fd: sp, m: map[C.int]net.Addr{}}
+	listener := &listener{
+		s:    s,
+		ln:   ln,
+		fd:   sp,
+		done: make(chan struct{}),
+		m:    map[C.int]net.Addr{},
+	}
 	listeners.m[fdC] = listener
 	listeners.mu.Unlock()
 
 	cleanup := func() {
-		// If fdC is closed on the C side, then we end up calling
-		// into cleanup twice. Be careful to avoid syscall.Close
-		// twice as the FD may have been reallocated.
 		listeners.mu.Lock()
-		if tsLn, ok := listeners.m[fdC]; ok && tsLn.ln == ln {
+		if tsLn, ok := listeners.m[fdC]; ok && tsLn == listener {
 			delete(listeners.m, fdC)
-			syscall.Close(sp)
 		}
 		listeners.mu.Unlock()
 
+		listener.closeFd()
 		ln.Close()
 	}
 	go func() {
@@ -268,6 +490,7 @@ func TsnetListen(sd C.int, network, addr *C.char, listenerOut *C.int) C.int {
 		cleanup()
 	}()
 	go func() {
+		defer close(listener.done)
 		defer cleanup()
 		for {
 			netConn, err := ln.Accept()
@@ -306,8 +529,56 @@ func TsnetListen(sd C.int, network, addr *C.char, listenerOut *C.int) C.int {
 	return 0
 }
 
+//export TsnetListenerClose
+func TsnetListenerClose(listenerFd C.int) C.int {
+	// Claim ln by removing it from listeners, so that of two
+	// concurrent callers only one closes listenerFd.
+	listeners.mu.Lock()
+	ln := listeners.m[listenerFd]
+	delete(listeners.m, listenerFd)
+	listeners.mu.Unlock()
+
+	if ln == nil {
+		return C.EBADF
+	}
+
+	// Closing ln.ln stops the accept goroutine, which closes the Go
+	// side of the socketpair as it exits. Shutting that side down
+	// first wakes the goroutine if it is blocked in sendmsg because C
+	// stopped accepting and the socketpair is full.
+	ln.ln.Close()
+	ln.shutdownFd()
+	<-ln.done
+	if err := syscall.Close(int(listenerFd)); err != nil {
+		return ln.s.recErr(err)
+	}
+	return 0
+}
+
+// acceptNonblock is TAILSCALE_ACCEPT_NONBLOCK in tailscale.h.
+const acceptNonblock = 1
+
+//export TsnetListenerAddr
+func TsnetListenerAddr(listenerFd C.int, buf *C.char, buflen C.size_t) C.int {
+	out := outBuf("listener_addr", buf, buflen)
+
+	listeners.mu.Lock()
+	ln := listeners.m[listenerFd]
+	listeners.mu.Unlock()
+
+	if ln == nil {
+		return C.EBADF
+	}
+	return writeOut(out, ln.ln.Addr().String())
+}
+
 //export TsnetAccept
 func TsnetAccept(listenerFd C.int, connOut *C.int) C.int {
+	return TsnetAcceptFlags(listenerFd, 0, connOut)
+}
+
+//export TsnetAcceptFlags
+func TsnetAcceptFlags(listenerFd C.int, flags C.int, connOut *C.int) C.int {
 	listeners.mu.Lock()
 	ln := listeners.m[listenerFd]
 	listeners.mu.Unlock()
@@ -315,10 +586,66 @@ func TsnetAccept(listenerFd C.int, connOut *C.int) C.int {
 	if ln == nil {
 		return C.EBADF
 	}
+	if flags&^acceptNonblock != 0 {
+		ln.s.recErr(fmt.Errorf("libtailscale: unknown accept flags %#x", int(flags&^acceptNonblock)))
+		return C.EINVAL
+	}
+	var recvFlags int
+	if flags&acceptNonblock != 0 {
+		recvFlags = syscall.MSG_DONTWAIT
+	}
+	return ln.accept(listenerFd, recvFlags, connOut)
+}
+
+//export TsnetAcceptTimeout
+func TsnetAcceptTimeout(listenerFd C.int, timeoutMillis C.int, connOut *C.int) C.int {
+	listeners.mu.Lock()
+	ln := listeners.m[listenerFd]
+	listeners.mu.Unlock()
+
+	if ln == nil {
+		return C.EBADF
+	}
+	if timeoutMillis <= 0 {
+		ln.s.recErr(errors.New("libtailscale: accept timeout must be positive"))
+		return C.EINVAL
+	}
+	timeout := time.Duration(timeoutMillis) * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	for {
+		// Another thread may accept the connection between poll and
+		// recvmsg, so don't block in recvmsg, and poll again if it
+		// finds nothing.
+		wait := time.Until(deadline)
+		if wait < 0 {
+			wait = 0
+		}
+		fds := []unix.PollFd{{Fd: int32(listenerFd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(wait.Milliseconds()))
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return ln.s.recErr(err)
+		}
+		if n == 0 {
+			ln.s.recErr(fmt.Errorf("libtailscale: no connection to accept after %v", timeout))
+			return C.ETIMEDOUT
+		}
+		if ret := ln.accept(listenerFd, syscall.MSG_DONTWAIT, connOut); ret != C.EAGAIN {
+			return ret
+		}
+	}
+}
 
+// accept receives the next connection sent over the listener socketpair
+// whose C side is listenerFd, passing flags to recvmsg(2). It returns
+// EAGAIN if flags has MSG_DONTWAIT and there is no connection waiting.
+func (ln *listener) accept(listenerFd C.int, flags int, connOut *C.int) C.int {
 	buf := make([]byte, unix.CmsgLen(int(unsafe.Sizeof((C.int)(0)))))
-	_, oobn, _, _, err := syscall.Recvmsg(int(listenerFd), nil, buf, 0)
-	if err != nil {
+	_, oobn, _, _, err := syscall.Recvmsg(int(listenerFd), nil, buf, flags)
+	if err == syscall.EAGAIN {
+		return C.EAGAIN
+	} else if err != nil {
 		return ln.s.recErr(err)
 	}
 
@@ -346,21 +673,38 @@ func newConn(s *server, netConn net.Conn, connOut *C.int) error {
 	if err != nil {
 		return err
 	}
-	r := os.NewFile(uintptr(fds[1]), "socketpair-r")
-	c := &conn{s: s.s, c: netConn, r: r}
 	fdC := C.int(fds[0])
+	startConn(s, netConn, fdC, os.NewFile(uintptr(fds[1]), "socketpair-r"))
+	*connOut = fdC
+	return nil
+}
+
+// startConn registers the socketpair connection whose C side is fdC and
+// copies data between r, the Go side, and netConn until either closes.
+func startConn(s *server, netConn net.Conn, fdC C.int, r *os.File) {
+	c := &conn{s: s.s, c: netConn, r: r}
+	registerConn(fdC, c)
+	c.serve(fdC)
+}
 
+// registerConn records c as the connection whose C side is fdC.
+func registerConn(fdC C.int, c *conn) {
 	conns.mu.Lock()
 	if conns.m == nil {
 		conns.m = make(map[C.int]*conn)
 	}
 	conns.m[fdC] = c
 	conns.mu.Unlock()
+}
 
+// serve copies data between c.r and c.c until either closes, then
+// unregisters c, which is registered as fdC.
+func (c *conn) serve(fdC C.int) {
+	netConn, r := c.c, c.r
 	connCleanup := func() {
 		var inCleanup bool
 		conns.mu.Lock()
-		if tsConn, ok := conns.m[fdC]; ok && tsConn.c == netConn {
+		if conns.m[fdC] == c {
 			delete(conns.m, fdC)
 			inCleanup = true
 		}
@@ -391,9 +735,6 @@ func newConn(s *server, netConn net.Conn, connOut *C.int) error {
 			cw.CloseWrite()
 		}
 	}()
-
-	*connOut = fdC
-	return nil
 }
 
 //export TsnetGetRemoteAddr
@@ -445,11 +786,13 @@ func TsnetDial(sd C.int, network, addr *C.char, connOut *C.int) C.int {
 	if s == nil {
 		return C.EBADF
 	}
-	netConn, err := s.s.Dial(context.Background(), C.GoString(network), C.GoString(addr))
-	if err != nil {
+	if err := s.start(); err != nil {
 		return s.recErr(err)
 	}
-	s.started = true
+	netConn, err := s.s.Dial(s.ctx, C.GoString(network), C.GoString(addr))
+	if err != nil {
+		return s.dialErr(s.ctx, err)
+	}
 	if err := newConn(s, netConn, connOut); err != nil {
 		return s.recErr(err)
 	}
@@ -472,8 +815,16 @@ func TsnetSetHostname(sd C.int, str *C.char) C.int {
 	if s == nil {
 		return C.EBADF
 	}
+	old := s.s.Hostname
 	s.s.Hostname = C.GoString(str)
-	return 0
+	if !s.started {
+		return 0
+	}
+	err := s.setHostname(s.ctx, s.s.Hostname)
+	if err != nil {
+		s.s.Hostname = old
+	}
+	return s.recWaitErr(err)
 }
 
 //export TsnetSetAuthKey
@@ -528,59 +879,6 @@ func TsnetSetLogFD(sd, fd C.int) C.int {
 	return 0
 }
 
-//export TsnetLoopback
-func TsnetLoopback(sd C.int, addrOut *C.char, addrLen C.size_t, proxyOut *C.char, localOut *C.char) C.int {
-	// Panic here to ensure we always leave the out values NUL-terminated.
-	if addrOut == nil {
-		panic("loopback_api passed nil addr_out")
-	} else if addrLen == 0 {
-		panic("loopback_api passed addrlen of 0")
-	} else if proxyOut == nil {
-		panic("loopback_api passed nil proxy_cred_out")
-	} else if localOut == nil {
-		panic("loopback_api passed nil local_api_cred_out")
-	}
-
-	// Start out NUL-termianted to cover error conditions.
-	*addrOut = '\x00'
-	*localOut = '\x00'
-	*proxyOut = '\x00'
-
-	s := getServer(sd)
-	if s == nil {
-		return C.EBADF
-	}
-	addr, proxyCred, localAPICred, err := s.s.Loopback()
-	if err != nil {
-		return s.recErr(err)
-	}
-	if len(proxyCred) != 32 {
-		return s.recErr(fmt.Errorf("libtailscale: len(proxyCred)=%d, want 32", len(proxyCred)))
-	}
-	if len(localAPICred) != 32 {
-		return s.recErr(fmt.Errorf("libtailscale: len(localAPICred)=%d, want 32", len(localAPICred)))
-	}
-
-	out := unsafe.Slice((*byte)(unsafe.Pointer(addrOut)), addrLen)
-	n := copy(out, addr)
-	if n >= len(out) {
-		out[len(out)-1] = '\x00' // always NUL-terminate
-		return C.ERANGE
-	}
-	out[n] = '\x00'
-
-	// proxyOut and localOut are non-nil and 33 bytes long because
-	// they are defined in C as char cred_out[static 33].
-	out = unsafe.Slice((*byte)(unsafe.Pointer(proxyOut)), 33)
-	copy(out, proxyCred)
-	out[32] = '\x00'
-	out = unsafe.Slice((*byte)(unsafe.Pointer(localOut)), 33)
-	copy(out, localAPICred)
-	out[32] = '\x00'
-
-	return 0
-}
-
 //export TsnetEnableFunnelToLocalhostPlaintextHttp1
 func TsnetEnableFunnelToLocalhostPlaintextHttp1(sd C.int, localhostPort C.int) C.int {
 	s := getServer(sd)
@@ -589,7 +887,7 @@ func TsnetEnableFunnelToLocalhostPlaintextHttp1(sd C.int, localhostPort C.int) C
 	}
 
 	ctx := context.Background()
-	lc, err := s.s.LocalClient()
+	lc, err := s.localClient()
 	if err != nil {
 		return s.recErr(err)
 	}
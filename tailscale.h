@@ -21,6 +21,7 @@
 extern "C" {
 #endif
 
+struct addrinfo;
 
 // tailscale is a handle onto a Tailscale server.
 typedef int tailscale;
@@ -44,9 +45,174 @@ extern int tailscale_start(tailscale sd);
 //
 // To cancel an in-progress call to tailscale_up, use tailscale_close.
 //
-// Returns zero on success or -1 on error, call tailscale_errmsg for details.
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	ECANCELED - tailscale_close was called while waiting
+// 	-1        - other error, call tailscale_errmsg for details
 extern int tailscale_up(tailscale sd);
 
+// tailscale_wait_peer waits until the peer name_or_ip is in the server's
+// netmap and online, so that startup code can call tailscale_up and then
+// dial a peer without racing it onto the tailnet.
+//
+// name_or_ip is a NUL-terminated Tailscale IP or MagicDNS name, short or
+// fully qualified, of another node on the tailnet.
+//
+// timeout_ms bounds how long to wait. A negative timeout_ms waits until
+// the peer is online or tailscale_close is called.
+//
+// It will start the server if it has not been started yet.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	EINVAL    - name_or_ip is empty or timeout_ms is zero
+// 	ETIMEDOUT - the peer was not online within timeout_ms
+// 	ECANCELED - tailscale_close was called while waiting
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_wait_peer(tailscale sd, const char* name_or_ip, int timeout_ms);
+
+// tailscale_watch_peers watches the server's netmap for peers matching
+// filter joining, leaving or changing, for service discovery.
+//
+// filter is a NUL-terminated string, matched case-insensitively:
+//
+// 	"" or NULL    - every peer
+// 	"tag:NAME"    - peers tagged tag:NAME
+// 	"user:LOGIN"  - peers owned by the user with login name LOGIN
+// 	anything else - a shell pattern, as in fnmatch(3), for the peer's
+// 	                MagicDNS short name, e.g. "web-*"
+//
+// On success *fd_out is a file descriptor from which events can be read,
+// one JSON object per line:
+//
+// 	{
+// 	  "Event": "added",                 // or "removed" or "changed"
+// 	  "Peer": {
+// 	    "ID": "nXXXXXCNTRL",            // stable node ID
+// 	    "Name": "web-1.tailnet-1234.ts.net",
+// 	    "HostName": "web-1",            // the hostname the peer reports
+// 	    "User": "alice@example.com",    // if the peer is not tagged
+// 	    "Tags": ["tag:web"],
+// 	    "TailscaleIPs": ["100.64.0.3", "fd7a:115c:a1e0::3"],
+// 	    "Online": true
+// 	  }
+// 	}
+//
+// The first events are "added" for the peers that already match. A peer
+// that stops matching filter, for example because its tags changed, is
+// "removed". "changed" carries the new state of a peer whose other fields
+// changed, such as going offline.
+//
+// As with tailscale_listener, epoll or its equivalent can be used on the
+// fd. Close it with close(2) to stop watching. After tailscale_close,
+// reads return end of file.
+//
+// It will start the server if it has not been started yet.
+//
+// Returns:
+// 	0      - success
+// 	EBADF  - sd is not a valid tailscale
+// 	EINVAL - filter is not a valid pattern
+// 	-1     - other error, call tailscale_errmsg for details
+extern int tailscale_watch_peers(tailscale sd, const char* filter, int* fd_out);
+
+// tailscale_logout logs the server out of the tailnet, as when a user signs
+// out of an app.
+//
+// The node key is deleted from the state store in the server's directory
+// and the server is left in the NeedsLogin state: connections, listeners
+// and dials to the tailnet stop working. The server is not closed, so a
+// later tailscale_up, after a new key is set with tailscale_set_authkey,
+// registers the node again with the same control server and hostname.
+//
+// It will start the server if it has not been started yet.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	ECANCELED - tailscale_close was called while waiting
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_logout(tailscale sd);
+
+// tailscale_reauth logs a running server in again with a new auth key,
+// for example when its node key has expired, and waits for it to be usable
+// as tailscale_up does.
+//
+// authkey is a NUL-terminated auth key. It also replaces any key set with
+// tailscale_set_authkey.
+//
+// The server is not restarted: listeners stay open, and keep accepting
+// connections once the node is running again.
+//
+// To cancel an in-progress call to tailscale_reauth, use tailscale_close.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	ECANCELED - tailscale_close was called while waiting
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_reauth(tailscale sd, const char* authkey);
+
+// tailscale_profiles_list writes the server's login profiles to buf as a
+// JSON array. Each login profile is a node identity on a tailnet, and one
+// server can switch between several of them:
+//
+// 	[
+// 	  {
+// 	    "ID": "3f2a",                  // for tailscale_profile_switch
+// 	    "Name": "alice@example.com",   // the user logged in
+// 	    "Tailnet": "example.com",
+// 	    "MagicDNS": "tailnet-1234.ts.net",
+// 	    "ControlURL": "https://controlplane.tailscale.com",
+// 	    "Current": true                // the profile in use
+// 	  }
+// 	]
+//
+// It will start the server if it has not been started yet.
+// After returning, buf is always NUL-terminated.
+//
+// Returns:
+// 	0      - success
+// 	EBADF  - sd is not a valid tailscale
+// 	ERANGE - insufficient storage for buf
+// 	-1     - other error, call tailscale_errmsg for details
+extern int tailscale_profiles_list(tailscale sd, char* buf, size_t buflen);
+
+// tailscale_profile_switch switches the server to the login profile with
+// the NUL-terminated ID profile_id, and waits for it to be usable as
+// tailscale_up does.
+//
+// On a switch, the server's tailscale_conn connections are closed, as
+// they used the old profile's addresses. Listeners bound to one of those
+// addresses, like "100.64.0.1:80", are closed too: tailscale_accept on
+// them fails. Listeners bound to a port only, like ":80", stay open and
+// accept connections to the new profile's addresses. Switching to the
+// current profile does nothing.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	ECANCELED - tailscale_close was called while waiting
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_profile_switch(tailscale sd, const char* profile_id);
+
+// tailscale_profile_add logs the server in to a new login profile with
+// authkey, switching to it as tailscale_profile_switch does. The current
+// profile is kept, to switch back to later.
+//
+// The new profile uses the same control server and hostname as the
+// current one. authkey may be NULL to log in interactively. If the login
+// fails, the server switches back to the current profile.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	ECANCELED - tailscale_close was called while waiting
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_profile_add(tailscale sd, const char* authkey);
+
 // tailscale_close shuts down the server.
 //
 // Returns:
@@ -58,6 +224,12 @@ extern int tailscale_close(tailscale sd);
 // The following set tailscale configuration options.
 //
 // Configure these options before any explicit or implicit call to tailscale_start.
+// The exception is tailscale_set_hostname, which also renames a running
+// server, waiting for the control server to update its MagicDNS name to
+// match. If the control server reports an error, picks another name, or
+// does not rename the node within 10 seconds, the previous hostname is
+// restored. tailscale_close interrupts the wait, which then returns
+// ECANCELED.
 //
 // For details of each value see the godoc for the fields of tsnet.Server.
 //
@@ -85,16 +257,86 @@ typedef int tailscale_conn;
 // a comma separated list.
 //
 // The provided buffer must be of sufficient size to hold the concatenated
-// IPs as strings.  This is typically <ipv4>,<ipv6> but maybe empty, or
-// contain any number of ips.   The caller is responsible for parsing
+// IPs as strings.  This is typically <ipv4>,<ipv6> but may contain any
+// number of ips.   The caller is responsible for parsing
 // the output.  You may assume the output is a list of well-formed IPs.
 //
 // Returns:
-//  0      - Success
-// 	EBADF  - sd is not a valid tailscale, or l or conn are not valid listeneras or connections
-// 	ERANGE - insufficient storage for buf
+//  0        - Success
+// 	EBADF    - sd is not a valid tailscale, or l or conn are not valid listeneras or connections
+// 	ERANGE   - insufficient storage for buf
+// 	ENOTCONN - no addresses are assigned yet, e.g. before tailscale_up
 extern int tailscale_getips(tailscale sd, char* buf, size_t buflen);
 
+// tailscale_self_json writes information about this node to buf as a JSON
+// object:
+//
+// 	{
+// 	  "ID": "nQ7Ab9CNTRL",                  // stable node ID
+// 	  "Name": "myhost.tailnet-1234.ts.net", // FQDN, without the trailing dot
+// 	  "HostName": "myhost",
+// 	  "MagicDNSSuffix": "tailnet-1234.ts.net",
+// 	  "Tailnet": "example.com",
+// 	  "User": "alice@example.com",          // login name of the owner
+// 	  "Tags": ["tag:server"],               // omitted if untagged
+// 	  "KeyExpiry": "2026-01-02T15:04:05Z",  // omitted if the key does not expire
+// 	  "TailscaleIPs": ["100.64.0.1", "fd7a:115c:a1e0::1"]
+// 	}
+//
+// After returning, buf is always NUL-terminated.
+//
+// Returns:
+// 	0        - success
+// 	EBADF    - sd is not a valid tailscale
+// 	ERANGE   - insufficient storage for buf
+// 	ENOTCONN - no addresses are assigned yet, e.g. before tailscale_up
+// 	-1       - other error, call tailscale_errmsg for details
+extern int tailscale_self_json(tailscale sd, char* buf, size_t buflen);
+
+// tailscale_resolve looks up name on the tailnet.
+//
+// name is a NUL-terminated MagicDNS short name (e.g. "myhost"), a fully
+// qualified MagicDNS name (e.g. "myhost.tailnet-1234.ts.net"), or the name
+// of an extra DNS record configured for the tailnet. It is resolved using
+// the node's current netmap and DNS config, without sending any DNS queries.
+// An IP address literal resolves to itself.
+//
+// All addresses of the name are written to buf as a comma separated list,
+// in the same format as tailscale_getips.
+//
+// Returns:
+// 	0          - success
+// 	EBADF      - sd is not a valid tailscale
+// 	ERANGE     - insufficient storage for buf
+// 	EAI_NONAME - name does not exist on the tailnet
+// 	EAI_AGAIN  - the server is not running yet, try again after tailscale_up
+// 	EAI_FAIL   - other error, call tailscale_errmsg for details
+extern int tailscale_resolve(tailscale sd, const char* name, char* buf, size_t buflen);
+
+// tailscale_getaddrinfo is a drop-in replacement for getaddrinfo(3) that
+// resolves names through the tailnet.
+//
+// It follows the contract of getaddrinfo(3): node, service, hints and
+// the list written to res have the same meaning, and on failure it returns
+// one of the EAI_* error codes, suitable for gai_strerror(3).
+//
+// MagicDNS names and extra records are resolved as by tailscale_resolve,
+// and names under a split DNS route of the tailnet are resolved by the
+// route's nameservers, queried through the tailnet. Other names, numeric
+// hosts, and all names before the server is running, are resolved with
+// the system getaddrinfo.
+//
+// The list written to res must be freed with tailscale_freeaddrinfo, not
+// freeaddrinfo(3).
+//
+// If sd is not a valid tailscale, EAI_SYSTEM is returned and errno is
+// set to EBADF. For other errors where EAI_FAIL is returned, call
+// tailscale_errmsg for details.
+extern int tailscale_getaddrinfo(tailscale sd, const char* node, const char* service, const struct addrinfo* hints, struct addrinfo** res);
+
+// tailscale_freeaddrinfo frees a list returned by tailscale_getaddrinfo.
+extern void tailscale_freeaddrinfo(struct addrinfo* res);
+
 // tailscale_dial connects to the address on the tailnet.
 //
 // The newly allocated connection is written to conn_out.
@@ -104,13 +346,140 @@ extern int tailscale_getips(tailscale sd, char* buf, size_t buflen);
 //
 // It will start the server if it has not been started yet.
 //
-// Returns zero on success or -1 on error, call tailscale_errmsg for details.
+// Connecting to a peer that is offline can block for minutes. To bound
+// the wait, use tailscale_dial_timeout. To cancel an in-progress dial,
+// use tailscale_close.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	ECANCELED - tailscale_close was called while dialing
+// 	-1        - other error, call tailscale_errmsg for details
 extern int tailscale_dial(tailscale sd, const char* network, const char* addr, tailscale_conn* conn_out);
 
+// tailscale_dial_timeout is tailscale_dial, giving up after timeout_ms
+// milliseconds, which must be positive.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	EINVAL    - timeout_ms is not positive
+// 	ETIMEDOUT - the connection was not made within timeout_ms
+// 	ECANCELED - tailscale_close was called while dialing
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_dial_timeout(tailscale sd, const char* network, const char* addr, int timeout_ms, tailscale_conn* conn_out);
+
+// tailscale_dial_async is tailscale_dial for event loops. It returns
+// EINPROGRESS at once, having written the new connection to conn_out,
+// and connects in the background, like connect(2) on a non-blocking socket.
+//
+// conn_out polls as writable when the dial completes, whether or not it
+// succeeded; call tailscale_conn_error to find out. If the dial failed,
+// conn_out also reads end-of-file. Either way, close conn_out when done.
+//
+// Returns:
+// 	EINPROGRESS - the dial was started
+// 	EBADF       - sd is not a valid tailscale
+// 	-1          - other error, call tailscale_errmsg for details
+extern int tailscale_dial_async(tailscale sd, const char* network, const char* addr, tailscale_conn* conn_out);
+
+// tailscale_conn_error reports the state of conn, the analog of the
+// SO_ERROR socket option for tailscale_dial_async.
+//
+// Returns:
+// 	0           - conn is connected
+// 	EINPROGRESS - conn is still being dialed by tailscale_dial_async
+// 	EBADF       - conn is not a valid tailscale_conn
+// 	ECANCELED   - tailscale_close was called while dialing
+// 	other errno - the dial failed, call tailscale_errmsg for details
+// 	-1          - the dial failed, call tailscale_errmsg for details
+extern int tailscale_conn_error(tailscale_conn conn);
+
+// tailscale_dial_tag connects to port on any online peer tagged tag, for
+// reaching one of several replicas of a service.
+//
+// network is a NUL-terminated string of the form "tcp", "udp", etc.
+// tag is a NUL-terminated ACL tag such as "tag:api".
+//
+// policy is a NUL-terminated string choosing the order in which the
+// matching peers are tried:
+//
+// 	"round-robin"    - each call starts with the peer after the one the
+// 	                   previous call for tag started with (the default
+// 	                   if policy is NULL or empty)
+// 	"random"         - a random order
+// 	"lowest-latency" - the peers are pinged first, fastest first
+//
+// If connecting to a peer fails, or takes over 5 seconds, the next peer is
+// tried. The newly allocated connection is written to conn_out.
+//
+// The server must be running, see tailscale_up.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	EINVAL    - tag, port or policy is invalid
+// 	ENOENT    - no online peer is tagged tag
+// 	ECANCELED - tailscale_close was called while dialing
+// 	-1        - other error, including failing to connect to every peer,
+// 	            call tailscale_errmsg for details
+extern int tailscale_dial_tag(tailscale sd, const char* network, const char* tag, int port, const char* policy, tailscale_conn* conn_out);
+
+// tailscale_dial_verified connects to the address on the tailnet, as
+// tailscale_dial does, and then checks that the node on the other end is
+// the expected one, so that a connection is not made to whichever node
+// currently has an IP address or name.
+//
+// expected is a NUL-terminated JSON object with one or more of:
+//
+// 	{
+// 	  "ID": "nXXXXXCNTRL",         // the node's stable node ID
+// 	  "User": "alice@example.com", // login name of the owner of an untagged node
+// 	  "Tag": "tag:api"             // one of the node's tags
+// 	}
+//
+// Every field that is set must match. The node is identified by looking
+// up the connection's remote address, after connecting.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	EINVAL    - expected is not a valid JSON object as above
+// 	EPERM     - the node is not the expected one; the connection is closed
+// 	            and tailscale_errmsg says which field did not match
+// 	ECANCELED - tailscale_close was called while dialing
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_dial_verified(tailscale sd, const char* network, const char* addr, const char* expected, tailscale_conn* conn_out);
+
+// tailscale_dial_tls connects over TCP to addr on the tailnet and performs
+// a TLS handshake, for talking to peers serving HTTPS with their ts.net
+// certificates without a TLS library in C.
+//
+// addr is a NUL-terminated "host:port" string, or just a host to use port
+// 443. If host is a peer, by MagicDNS name or Tailscale IP, its
+// certificate must be valid for the peer's full MagicDNS name, e.g.
+// "web.tailnet-1234.ts.net". Otherwise it must be valid for host.
+// Certificates are verified against the system's trusted roots.
+//
+// The newly allocated connection is written to conn_out. Reads and writes
+// on it are plaintext, encrypted and decrypted by the library, and
+// shutdown(2) with SHUT_WR sends a TLS close_notify.
+//
+// It will start the server if it has not been started yet.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	EPERM     - the server's certificate could not be verified
+// 	ECANCELED - tailscale_close was called while dialing
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_dial_tls(tailscale sd, const char* addr, tailscale_conn* conn_out);
+
 // A tailscale_listener is a socket on the tailnet listening for connections.
 //
 // It is much like allocating a system socket(2) and calling listen(2).
-// Accept connections with tailscale_accept and close the listener  with close.
+// Accept connections with tailscale_accept and close the listener with
+// tailscale_listener_close or close.
 //
 // Under the hood, a tailscale_listener is one half of a socketpair itself,
 // used to move the connection fd from Go to C. This means you can use epoll
@@ -125,12 +494,25 @@ typedef int tailscale_listener;
 //
 // network is a NUL-terminated string of the form "tcp", "udp", etc.
 // addr is a NUL-terminated string of an IP address or domain name.
+// If its port is 0, as in ":0", an unused port is chosen; use
+// tailscale_listener_addr to find out which.
 //
 // It will start the server if it has not been started yet.
 //
 // Returns zero on success or -1 on error, call tailscale_errmsg for details.
 extern int tailscale_listen(tailscale sd, const char* network, const char* addr, tailscale_listener* listener_out);
 
+// tailscale_listener_addr writes the address listener is listening on,
+// like ":8080" or "100.64.0.1:8080", to buf as a NUL-terminated string.
+//
+// It is the spiritual equivalent to getsockname(2).
+//
+// Returns:
+// 	0      - success
+// 	EBADF  - listener is not a valid tailscale_listener
+// 	ERANGE - insufficient storage for buf
+extern int tailscale_listener_addr(tailscale_listener listener, char* buf, size_t buflen);
+
 // Returns the remote address for an incoming connection for a particular listener.  The address (eitehr ip4 or ip6)
 // will ge written to buf on on success.
 // Returns:
@@ -152,14 +534,63 @@ extern int tailscale_getremoteaddr(tailscale_listener l, tailscale_conn conn, ch
 // 	-1    - call tailscale_errmsg for details
 extern int tailscale_accept(tailscale_listener listener, tailscale_conn* conn_out);
 
+// TAILSCALE_ACCEPT_NONBLOCK makes tailscale_accept_flags return EAGAIN
+// rather than block if no connection is waiting.
+#define TAILSCALE_ACCEPT_NONBLOCK 1
+
+// tailscale_accept_flags is tailscale_accept with flags, which is zero or
+// TAILSCALE_ACCEPT_NONBLOCK.
+//
+// A non-blocking accept is needed when several threads poll the same
+// listener, as another thread may take the connection first.
+//
+// Returns:
+// 	0      - success
+// 	EBADF  - listener is not a valid tailscale_listener
+// 	EINVAL - flags is invalid
+// 	EAGAIN - TAILSCALE_ACCEPT_NONBLOCK is set and no connection is waiting
+// 	-1     - call tailscale_errmsg for details
+extern int tailscale_accept_flags(tailscale_listener listener, int flags, tailscale_conn* conn_out);
+
+// tailscale_accept_timeout is tailscale_accept, giving up after timeout_ms
+// milliseconds, which must be positive.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - listener is not a valid tailscale_listener
+// 	EINVAL    - timeout_ms is not positive
+// 	ETIMEDOUT - no connection was accepted within timeout_ms
+// 	-1        - call tailscale_errmsg for details
+extern int tailscale_accept_timeout(tailscale_listener listener, int timeout_ms, tailscale_conn* conn_out);
+
+// tailscale_listener_close closes listener and stops listening on the
+// tailnet.
+//
+// Unlike close(2), which the library notices in the background, it returns
+// only once the listener is gone, so its address can be listened on again
+// at once. Connections already accepted are not closed.
+//
+// Returns:
+// 	0     - success
+// 	EBADF - listener is not a valid tailscale_listener, or it was closed
+// 	        by a profile switch, in which case close it with close(2)
+// 	-1    - call tailscale_errmsg for details
+extern int tailscale_listener_close(tailscale_listener listener);
+
 // tailscale_loopback starts a loopback address server.
 //
 // The server has multiple functions.
 //
-// It can be used as a SOCKS5 proxy onto the tailnet.
+// It can be used as a SOCKS5 proxy onto the tailnet, supporting both
+// the CONNECT and UDP ASSOCIATE commands.
 // Authentication is required with the username "tsnet" and
 // the value of proxy_cred used as the password.
 //
+// It can also be used as an HTTP proxy onto the tailnet, supporting both
+// CONNECT and requests for absolute http:// URIs. Authentication is
+// required with a basic auth Proxy-Authorization header, again with the
+// username "tsnet" and proxy_cred as the password.
+//
 // The HTTP server also serves out the "LocalAPI" on /localapi.
 // As the LocalAPI is powerful, access to endpoints requires BOTH passing a
 // "Sec-Tailscale: localapi" HTTP header and passing local_api_cred as
@@ -175,6 +606,224 @@ extern int tailscale_accept(tailscale_listener listener, tailscale_conn* conn_ou
 // Returns zero on success or -1 on error, call tailscale_errmsg for details.
 extern int tailscale_loopback(tailscale sd, char* addr_out, size_t addrlen, char* proxy_cred_out, char* local_api_cred_out);
 
+// tailscale_loopback_rotate replaces the credentials of the loopback server
+// started by tailscale_loopback with new random values.
+//
+// The new credentials are written to proxy_cred_out and local_api_cred_out,
+// which must point to arrays that can hold 33 bytes as for tailscale_loopback.
+// The old credentials stop working immediately for new proxy connections and
+// LocalAPI requests. Connections already established are not affected.
+//
+// Returns zero on success or -1 on error, call tailscale_errmsg for details.
+// It is an error to call tailscale_loopback_rotate before tailscale_loopback.
+extern int tailscale_loopback_rotate(tailscale sd, char* proxy_cred_out, char* local_api_cred_out);
+
+// tailscale_loopback_stop stops the loopback server started by
+// tailscale_loopback, closing its listener and any proxy connections
+// through it, including CONNECT tunnels and SOCKS5 connections.
+//
+// A later call to tailscale_loopback starts a new loopback server on a
+// new address with new credentials. Calling tailscale_loopback_stop when
+// no loopback server is running does nothing.
+//
+// Returns zero on success or -1 on error, call tailscale_errmsg for details.
+extern int tailscale_loopback_stop(tailscale sd);
+
+// tailscale_dns_server starts a DNS server on listen_addr for programs
+// that cannot use tailscale_getaddrinfo, such as child processes using
+// tailscale_loopback as a proxy.
+//
+// listen_addr is a NUL-terminated "ip:port" string where ip must be a
+// loopback address, e.g. "127.0.0.1:5353". The port must not be zero, as
+// the server answers on it over both UDP and TCP.
+//
+// Queries for MagicDNS names, extra records and split DNS routes of the
+// tailnet are answered by the node's resolver, exactly as 100.100.100.100
+// answers them for other devices on the tailnet. Other queries are
+// forwarded to the nameservers in /etc/resolv.conf, unless the tailnet
+// configures its own global nameservers, in which case those are used.
+//
+// The DNS server runs until tailscale_close is called.
+//
+// It will start the server if it has not been started yet.
+//
+// Returns:
+// 	0      - success
+// 	EBADF  - sd is not a valid tailscale, or tailscale_close closed it meanwhile
+// 	-1     - other error, call tailscale_errmsg for details
+extern int tailscale_dns_server(tailscale sd, const char* listen_addr);
+
+// tailscale_ping sends a single ping to target and reports how it got there,
+// for debugging connectivity without the tailscale CLI.
+//
+// target is a NUL-terminated tailnet name or IP address, resolved as by
+// tailscale_resolve. type is one of:
+//
+// 	"disco" - a ping between the two nodes' magicsock layers, without
+// 	          involving IP at either end. Shows whether the path is direct
+// 	          or relayed. NULL or "" also mean "disco".
+// 	"TSMP"  - a ping at the IP layer, answered by the peer's Tailscale
+// 	          stack rather than its OS.
+// 	"ICMP"  - an ICMP echo request, answered by the peer's OS.
+//
+// timeout_ms bounds how long to wait for the reply, and must be positive.
+//
+// On success a JSON object describing the reply is written to buf:
+//
+// 	{
+// 	  "IP": "100.64.0.2",           // the address pinged
+// 	  "NodeIP": "100.64.0.2",       // Tailscale IP of the node that answered
+// 	  "NodeName": "peer",           // MagicDNS short name of the node that answered
+// 	  "Type": "disco",
+// 	  "LatencySeconds": 0.0023,
+// 	  "Endpoint": "192.0.2.1:41641", // if the path was direct UDP
+// 	  "PeerRelay": "...",           // if the path was via a peer relay
+// 	  "DERP": false,                // whether the path was via DERP
+// 	  "DERPRegionID": 1,            // if DERP, the region relaying
+// 	  "DERPRegionCode": "nyc"
+// 	}
+//
+// Endpoint, PeerRelay and DERP are not reported for TSMP pings.
+// After returning, buf is always NUL-terminated.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	EINVAL    - type or timeout_ms is invalid
+// 	ETIMEDOUT - no reply within timeout_ms
+// 	ECANCELED - tailscale_close was called while waiting
+// 	ERANGE    - insufficient storage for buf
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_ping(tailscale sd, const char* target, const char* type, int timeout_ms, char* buf, size_t buflen);
+
+// tailscale_netcheck runs a network connectivity check, the same check as
+// "tailscale netcheck", to help explain why connections are relayed.
+//
+// The check is run by the node itself, over the UDP socket it uses for
+// WireGuard, against the STUN and DERP servers in the DERP map from the
+// control server. The server must be running.
+//
+// On success a JSON object describing the network is written to buf:
+//
+// 	{
+// 	  "UDP": true,                   // a UDP STUN round trip completed
+// 	  "IPv4": true,                  // an IPv4 STUN round trip completed
+// 	  "IPv6": false,                 // an IPv6 STUN round trip completed
+// 	  "IPv4CanSend": true,
+// 	  "IPv6CanSend": false,
+// 	  "OSHasIPv6": true,
+// 	  "MappingVariesByDestIP": false, // true behind a hard NAT
+// 	  "GlobalV4": "192.0.2.1:41641",  // public address, if found
+// 	  "UPnP": null, "PMP": null, "PCP": null, "CaptivePortal": null,
+// 	  "PreferredDERP": 1,
+// 	  "PreferredDERPCode": "nyc",
+// 	  "Regions": [
+// 	    {"RegionID": 1, "RegionCode": "nyc", "LatencySeconds": 0.012,
+// 	     "V4LatencySeconds": 0.012}
+// 	  ]
+// 	}
+//
+// Fields that could not be determined are null. It can take several
+// seconds to run. After returning, buf is always NUL-terminated.
+//
+// Returns:
+// 	0         - success
+// 	EBADF     - sd is not a valid tailscale
+// 	ETIMEDOUT - the check did not complete
+// 	ECANCELED - tailscale_close was called while checking
+// 	ERANGE    - insufficient storage for buf
+// 	-1        - other error, call tailscale_errmsg for details
+extern int tailscale_netcheck(tailscale sd, char* buf, size_t buflen);
+
+// tailscale_set_exit_node routes traffic for addresses outside the tailnet,
+// such as tailscale_dial to a public host, through an exit node.
+//
+// node is a NUL-terminated stable node ID, as reported by
+// tailscale_list_exit_nodes and tailscale_suggest_exit_node, a Tailscale IP,
+// or a MagicDNS name. A NULL or empty node stops using an exit node.
+//
+// If allow_lan is non-zero, the local network stays directly reachable
+// while an exit node is in use.
+//
+// It will start the server if it has not been started yet.
+//
+// Returns zero on success or -1 on error, call tailscale_errmsg for details.
+extern int tailscale_set_exit_node(tailscale sd, const char* node, int allow_lan);
+
+// tailscale_list_exit_nodes writes the peers that can be used as an exit
+// node to buf as a JSON array, ordered by name:
+//
+// 	[
+// 	  {
+// 	    "ID": "nQ7Ab9CNTRL",          // stable node ID
+// 	    "Name": "exit.tailnet-1234.ts.net",
+// 	    "TailscaleIPs": ["100.64.0.3", "fd7a:115c:a1e0::3"],
+// 	    "Online": true,
+// 	    "Active": true,               // the current exit node
+// 	    "Location": {"Country": "Canada", "CountryCode": "CA", ...}
+// 	  }
+// 	]
+//
+// Online, Active and Location are omitted when false or unknown.
+// After returning, buf is always NUL-terminated.
+//
+// Returns:
+// 	0      - success
+// 	EBADF  - sd is not a valid tailscale
+// 	ERANGE - insufficient storage for buf
+// 	-1     - other error, call tailscale_errmsg for details
+extern int tailscale_list_exit_nodes(tailscale sd, char* buf, size_t buflen);
+
+// tailscale_suggest_exit_node picks the best exit node for this node, based
+// on DERP latency and the tailnet's exit node policy, the same as
+// "tailscale exit-node suggest". It does not change the exit node in use;
+// pass the suggested ID to tailscale_set_exit_node for that.
+//
+// The suggestion is written to buf as a JSON object with the ID, Name and
+// Location fields described for tailscale_list_exit_nodes.
+// After returning, buf is always NUL-terminated.
+//
+// Returns:
+// 	0      - success
+// 	EBADF  - sd is not a valid tailscale
+// 	ENOENT - no exit node is available
+// 	EAGAIN - the node has not measured DERP latency yet, try again later
+// 	ERANGE - insufficient storage for buf
+// 	-1     - other error, call tailscale_errmsg for details
+extern int tailscale_suggest_exit_node(tailscale sd, char* buf, size_t buflen);
+
+// tailscale_prefs_get_json writes the node's current preferences to buf as
+// a JSON object, the same as the LocalAPI's /localapi/v0/prefs endpoint.
+// Private keys are not included.
+//
+// It will start the server if it has not been started yet.
+// After returning, buf is always NUL-terminated.
+//
+// Returns:
+// 	0      - success
+// 	EBADF  - sd is not a valid tailscale
+// 	ERANGE - insufficient storage for buf
+// 	-1     - other error, call tailscale_errmsg for details
+extern int tailscale_prefs_get_json(tailscale sd, char* buf, size_t buflen);
+
+// tailscale_prefs_edit_json changes some of the node's preferences.
+//
+// masked_prefs_json is a NUL-terminated JSON object in the form of the
+// Go type ipn.MaskedPrefs: the preferences to change, as named by
+// tailscale_prefs_get_json, each along with a matching "<Name>Set": true
+// field. Preferences without a "<Name>Set" field are left as they are.
+// For example, to accept subnet routes and turn on shields up:
+//
+// 	{"RouteAll": true, "RouteAllSet": true,
+// 	 "ShieldsUp": true, "ShieldsUpSet": true}
+//
+// Unknown fields are an error.
+//
+// It will start the server if it has not been started yet.
+//
+// Returns zero on success or -1 on error, call tailscale_errmsg for details.
+extern int tailscale_prefs_edit_json(tailscale sd, const char* masked_prefs_json);
+
 // tailscale_enable_funnel_to_localhost_plaintext_http1 configures sd to have
 // Tailscale Funnel enabled, routing requests from the public web
 // (without any authentication) down to this Tailscale node, requesting new 
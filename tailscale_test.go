@@ -1,14 +1,28 @@
 package main
 
 import (
+	"crypto/x509"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/tailscale/libtailscale/tsnetctest"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
 )
 
 func TestConn(t *testing.T) {
-	tsnetctest.RunTestConn(t)
+	tsnetctest.RunTestConn(t, func(sd int, pool *x509.CertPool) {
+		servers.mu.Lock()
+		defer servers.mu.Unlock()
+		for k, s := range servers.m {
+			if int(k) == sd {
+				s.tlsRootCAs = pool
+			}
+		}
+	})
 
 	// RunTestConn cleans up after itself, so there shouldn't be
 	// anything left in the global maps.
@@ -21,7 +35,7 @@ func TestConn(t *testing.T) {
 		t.Fatalf("want no remaining tsnet objects, got %d", rem)
 	}
 
-	var remConns, remLns int
+	var remConns, remLns, remDials int
 
 	for i := 0; i < 50; i++ {
 		conns.mu.Lock()
@@ -32,7 +46,11 @@ func TestConn(t *testing.T) {
 		remLns = len(listeners.m)
 		listeners.mu.Unlock()
 
-		if remConns == 0 && remLns == 0 {
+		asyncDials.mu.Lock()
+		remDials = len(asyncDials.m)
+		asyncDials.mu.Unlock()
+
+		if remConns == 0 && remLns == 0 && remDials == 0 {
 			break
 		}
 
@@ -42,9 +60,9 @@ func TestConn(t *testing.T) {
 		// then Go responds to the other side being unreadable
 		// by closing the connections and listeners.
 		//
-		// This is inherently asynchronous.
-		// Without ditching the standard close(2) and having our
-		// own close functions.
+		// This is inherently asynchronous for anything closed
+		// with the standard close(2) rather than with
+		// tailscale_listener_close.
 		//
 		// So we spin for a while
 		time.Sleep(100 * time.Millisecond)
@@ -57,6 +75,10 @@ func TestConn(t *testing.T) {
 	if remLns > 0 {
 		t.Errorf("want no remaining tsnet_listener objects, got %d", remLns)
 	}
+
+	if remDials > 0 {
+		t.Errorf("want no remaining tailscale_dial_async objects, got %d", remDials)
+	}
 }
 
 func TestExtractIP(t *testing.T) {
@@ -77,3 +99,214 @@ func TestExtractIP(t *testing.T) {
 		t.Errorf("ipv6 port stripping failed %s != %s", got6, want6)
 	}
 }
+
+func TestFreePort(t *testing.T) {
+	used := map[int]bool{}
+	for p := dynamicPortMin; p <= dynamicPortMax; p++ {
+		used[p] = true
+	}
+	if p, ok := freePort(used, dynamicPortMin); ok {
+		t.Errorf("freePort with all ports used = %d, want none", p)
+	}
+
+	used[50000] = false
+	for _, start := range []int{dynamicPortMin, 50000, 60000, dynamicPortMax} {
+		if p, ok := freePort(used, start); !ok || p != 50000 {
+			t.Errorf("freePort(start %d) = %d, %v, want 50000", start, p, ok)
+		}
+	}
+
+	if p, ok := freePort(map[int]bool{60000: true}, 60000); !ok || p != 60001 {
+		t.Errorf("freePort skipping start = %d, %v, want 60001", p, ok)
+	}
+	if p, ok := freePort(map[int]bool{dynamicPortMax: true}, dynamicPortMax); !ok || p != dynamicPortMin {
+		t.Errorf("freePort wrapping = %d, %v, want %d", p, ok, dynamicPortMin)
+	}
+}
+
+func TestResolveTailnet(t *testing.T) {
+	node := func(name string, addrs ...string) tailcfg.NodeView {
+		n := &tailcfg.Node{Name: name}
+		for _, a := range addrs {
+			n.Addresses = append(n.Addresses, netip.MustParsePrefix(a))
+		}
+		return n.View()
+	}
+	nm := &netmap.NetworkMap{
+		SelfNode: node("self.tail-scale.ts.net.", "100.64.0.1/32", "fd7a:115c:a1e0::1/128"),
+		Peers: []tailcfg.NodeView{
+			node("peer.tail-scale.ts.net.", "100.64.0.2/32", "fd7a:115c:a1e0::2/128"),
+			node("other.corp.example.", "100.64.0.3/32"),
+		},
+		DNS: tailcfg.DNSConfig{
+			Domains: []string{"tail-scale.ts.net", "corp.example"},
+			ExtraRecords: []tailcfg.DNSRecord{
+				{Name: "db.tail-scale.ts.net.", Value: "100.64.0.9"},
+				{Name: "db.tail-scale.ts.net", Type: "TXT", Value: "ignored"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"peer", "100.64.0.2,fd7a:115c:a1e0::2"},
+		{"PEER", "100.64.0.2,fd7a:115c:a1e0::2"},
+		{"peer.tail-scale.ts.net", "100.64.0.2,fd7a:115c:a1e0::2"},
+		{"peer.tail-scale.ts.net.", "100.64.0.2,fd7a:115c:a1e0::2"},
+		{"self", "100.64.0.1,fd7a:115c:a1e0::1"},
+		{"other", "100.64.0.3"},
+		{"db", "100.64.0.9"},
+		{"peer.corp.example", ""},
+		{"nosuchhost", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		var got []string
+		_, addrs := resolveTailnet(nm, tt.name)
+		for _, ip := range addrs {
+			got = append(got, ip.String())
+		}
+		if s := strings.Join(got, ","); s != tt.want {
+			t.Errorf("resolveTailnet(%q) = %q, want %q", tt.name, s, tt.want)
+		}
+	}
+}
+
+func TestParseDNSAnswers(t *testing.T) {
+	build := func(rcode dnsmessage.RCode, add func(b *dnsmessage.Builder)) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, RCode: rcode})
+		b.StartAnswers()
+		if add != nil {
+			add(&b)
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	name := dnsmessage.MustNewName("db.corp.example.")
+	target := dnsmessage.MustNewName("db1.corp.example.")
+
+	msg := build(dnsmessage.RCodeSuccess, func(b *dnsmessage.Builder) {
+		b.CNAMEResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET}, dnsmessage.CNAMEResource{CNAME: target})
+		b.AResource(dnsmessage.ResourceHeader{Name: target, Class: dnsmessage.ClassINET}, dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+	})
+	canon, addrs, err := parseDNSAnswers(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canon != "db1.corp.example" || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("parseDNSAnswers = %q, %v; want db1.corp.example, [10.0.0.1]", canon, addrs)
+	}
+
+	if _, _, err := parseDNSAnswers(build(dnsmessage.RCodeNameError, nil)); err != errNXDomain {
+		t.Errorf("parseDNSAnswers(NXDOMAIN) err = %v, want errNXDomain", err)
+	}
+}
+
+func TestDNSUpstreams(t *testing.T) {
+	nameservers := []netip.Addr{
+		netip.MustParseAddr("127.0.0.53"),
+		netip.MustParseAddr("::ffff:192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+	}
+	for _, tt := range []struct {
+		self string
+		want string
+	}{
+		{"127.0.0.1:5353", "127.0.0.53:53,192.0.2.1:53,192.0.2.2:53"},
+		{"127.0.0.53:5353", "127.0.0.53:53,192.0.2.1:53,192.0.2.2:53"},
+		{"127.0.0.53:53", "192.0.2.1:53,192.0.2.2:53"},
+	} {
+		var got []string
+		for _, ap := range dnsUpstreams(nameservers, netip.MustParseAddrPort(tt.self)) {
+			got = append(got, ap.String())
+		}
+		if s := strings.Join(got, ","); s != tt.want {
+			t.Errorf("dnsUpstreams(%s) = %q, want %q", tt.self, s, tt.want)
+		}
+	}
+}
+
+func TestWatchPeersDiff(t *testing.T) {
+	web1 := watchedPeer{ID: "n1", Name: "web-1.tail-scale.ts.net", Tags: []string{"tag:web"}, Online: true}
+	web2 := watchedPeer{ID: "n2", Name: "web-2.tail-scale.ts.net", Tags: []string{"tag:web"}}
+	db := watchedPeer{ID: "n3", Name: "db.tail-scale.ts.net", User: "alice@example.com", Online: true}
+
+	for _, tt := range []struct {
+		filter string
+		want   string
+	}{
+		{"", "web-1,web-2,db"},
+		{"tag:web", "web-1,web-2"},
+		{"tag:WEB", "web-1,web-2"},
+		{"user:Alice@example.com", "db"},
+		{"web-*", "web-1,web-2"},
+		{"WEB-?", "web-1,web-2"},
+		{"db.tail-scale.ts.net", ""}, // patterns match the short name
+	} {
+		match, err := parsePeerFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("parsePeerFilter(%q): %v", tt.filter, err)
+		}
+		var got []string
+		for _, p := range []watchedPeer{web1, web2, db} {
+			if match(p) {
+				short, _, _ := strings.Cut(p.Name, ".")
+				got = append(got, short)
+			}
+		}
+		if s := strings.Join(got, ","); s != tt.want {
+			t.Errorf("parsePeerFilter(%q) matches %q, want %q", tt.filter, s, tt.want)
+		}
+	}
+	if _, err := parsePeerFilter("["); err == nil {
+		t.Error(`parsePeerFilter("[") succeeded, want error`)
+	}
+
+	web1Offline := web1
+	web1Offline.Online = false
+	old := map[tailcfg.StableNodeID]watchedPeer{"n1": web1, "n2": web2}
+	cur := map[tailcfg.StableNodeID]watchedPeer{"n1": web1Offline, "n3": db}
+	var got []string
+	for _, ev := range diffPeers(old, cur) {
+		got = append(got, ev.Event+" "+string(ev.Peer.ID))
+	}
+	if s, want := strings.Join(got, ","), "added n3,changed n1,removed n2"; s != want { // by name
+		t.Errorf("diffPeers = %q, want %q", s, want)
+	}
+	if evs := diffPeers(cur, cur); len(evs) != 0 {
+		t.Errorf("diffPeers of the same peers = %v, want none", evs)
+	}
+}
+
+func TestTaggedPeers(t *testing.T) {
+	online := true
+	node := func(name string, online *bool, tags []string, addrs ...string) tailcfg.NodeView {
+		n := &tailcfg.Node{Name: name, Online: online, Tags: tags}
+		for _, a := range addrs {
+			n.Addresses = append(n.Addresses, netip.MustParsePrefix(a))
+		}
+		return n.View()
+	}
+	nm := &netmap.NetworkMap{
+		Peers: []tailcfg.NodeView{
+			node("api-2.tail-scale.ts.net.", &online, []string{"tag:api"}, "fd7a:115c:a1e0::2/128", "100.64.0.2/32"),
+			node("api-1.tail-scale.ts.net.", &online, []string{"tag:web", "tag:api"}, "100.64.0.1/32"),
+			node("api-3.tail-scale.ts.net.", nil, []string{"tag:api"}, "100.64.0.3/32"), // offline
+			node("api-4.tail-scale.ts.net.", &online, []string{"tag:api"}, "fd7a:115c:a1e0::4/128"),
+			node("web.tail-scale.ts.net.", &online, []string{"tag:web"}, "100.64.0.5/32"),
+		},
+	}
+	var got []string
+	for _, c := range taggedPeers(nm, "tag:api") {
+		got = append(got, c.name+"="+c.ip.String())
+	}
+	want := "api-1.tail-scale.ts.net=100.64.0.1,api-2.tail-scale.ts.net=100.64.0.2,api-4.tail-scale.ts.net=fd7a:115c:a1e0::4"
+	if s := strings.Join(got, ","); s != want {
+		t.Errorf("taggedPeers = %q, want %q", s, want)
+	}
+}
@@ -6,6 +6,10 @@ package tsnetctest
 
 /*
 #include <errno.h>
+#include <netdb.h>
+#include <poll.h>
+#include <sys/ioctl.h>
+#include <sys/socket.h>
 #include <stdlib.h>
 #include <stdio.h>
 #include <string.h>
@@ -26,6 +30,7 @@ int errlen = 512;
 char* err = NULL;
 
 tailscale s1, s2;
+char* ips2 = NULL;
 
 int set_err(tailscale sd, char tag) {
 	err[0] = tag;
@@ -49,6 +54,17 @@ int test_conn() {
 	if ((ret = tailscale_set_dir(s1, tmps1)) != 0) {
 		return set_err(s1, '1');
 	}
+	if ((ret = tailscale_set_hostname(s1, "s1")) != 0) {
+		return set_err(s1, '1');
+	}
+	if ((ret = tailscale_resolve(s1, "s1", addr, addrlen)) != EAI_AGAIN) {
+		snprintf(err, errlen, "resolve before up = %d, want EAI_AGAIN", ret);
+		return 1;
+	}
+	if ((ret = tailscale_getips(s1, addr, addrlen)) != ENOTCONN) {
+		snprintf(err, errlen, "getips before up = %d (%s), want ENOTCONN", ret, addr);
+		return 1;
+	}
 	if ((ret = tailscale_set_logfd(s1, -1)) != 0) {
 		return set_err(s1, '2');
 	}
@@ -63,12 +79,19 @@ int test_conn() {
 	if ((ret = tailscale_set_dir(s2, tmps2)) != 0) {
 		return set_err(s2, '5');
 	}
+	if ((ret = tailscale_set_hostname(s2, "s2")) != 0) {
+		return set_err(s2, '5');
+	}
 	if ((ret = tailscale_set_logfd(s2, -1)) != 0) {
 		return set_err(s1, '6');
 	}
 	if ((ret = tailscale_up(s2)) != 0) {
 		return set_err(s2, '7');
 	}
+	ips2 = calloc(addrlen, 1);
+	if ((ret = tailscale_getips(s2, ips2, addrlen)) != 0) {
+		return set_err(s2, '7');
+	}
 
 	tailscale_listener ln;
 	if ((ret = tailscale_listen(s1, "tcp", ":8081", &ln)) != 0) {
@@ -124,96 +147,2373 @@ int test_conn() {
 	return 0;
 }
 
-int close_conn() {
-	if (tailscale_close(s1) != 0) {
-		return set_err(s1, 'd');
+tailscale_listener ln2;
+
+int listen_s2() {
+	if (tailscale_listen(s2, "tcp", ":8082", &ln2) != 0) {
+		return set_err(s2, 'i');
 	}
-	if (tailscale_close(s2) != 0) {
-		return set_err(s2, 'e');
+	return 0;
+}
+
+int accept_s2(tailscale_conn* conn) {
+	if (tailscale_accept(ln2, conn) != 0) {
+		return set_err(s2, 'j');
+	}
+	if (tailscale_listener_close(ln2) != 0) {
+		return set_err(s2, 'j');
 	}
 	return 0;
 }
-*/
-import "C"
-import (
-	"context"
-	"flag"
-	"io"
-	"net/http"
-	"net/http/httptest"
-	"os"
-	"path/filepath"
-	"testing"
-	"time"
 
-	"tailscale.com/net/netns"
-	"tailscale.com/tstest/integration"
-	"tailscale.com/tstest/integration/testcontrol"
-	"tailscale.com/types/logger"
-)
+tailscale_listener ln3;
 
-var verboseDERP = flag.Bool("verbose-derp", false, "if set, print DERP and STUN logs")
+int listen_s2_udp() {
+	if (tailscale_listen(s2, "udp", ":5300", &ln3) != 0) {
+		return set_err(s2, 'k');
+	}
+	return 0;
+}
 
-func RunTestConn(t *testing.T) {
-	// Corp#4520: don't use netns for tests.
-	netns.SetEnabled(false)
-	t.Cleanup(func() {
-		netns.SetEnabled(true)
-	})
+int accept_s2_udp(tailscale_conn* conn) {
+	if (tailscale_accept(ln3, conn) != 0) {
+		return set_err(s2, 'l');
+	}
+	if (tailscale_listener_close(ln3) != 0) {
+		return set_err(s2, 'l');
+	}
+	return 0;
+}
 
-	derpLogf := logger.Discard
-	if *verboseDERP {
-		derpLogf = t.Logf
+tailscale_listener ln_accept;
+
+int listen_accept_s2() {
+	if (tailscale_listen(s2, "tcp", ":8088", &ln_accept) != 0) {
+		return set_err(s2, 'H');
 	}
-	derpMap := integration.RunDERPAndSTUN(t, derpLogf, "127.0.0.1")
-	control := &testcontrol.Server{
-		DERPMap: derpMap,
+	return 0;
+}
+
+int accept_flags_s2(int flags) {
+	tailscale_conn c;
+	int ret;
+	if ((ret = tailscale_accept_flags(ln_accept, flags, &c)) != 0) {
+		set_err(s2, 'I');
+		return ret;
 	}
-	control.HTTPTestServer = httptest.NewUnstartedServer(control)
-	control.HTTPTestServer.Start()
-	t.Cleanup(control.HTTPTestServer.Close)
-	controlURL := control.HTTPTestServer.URL
-	t.Logf("testcontrol listening on %s", controlURL)
+	close(c);
+	return 0;
+}
 
-	C.control_url = C.CString(controlURL)
+int listener_close_s2() {
+	int ret;
+	if ((ret = tailscale_listener_close(ln_accept)) != 0) {
+		set_err(s2, 'I');
+	}
+	return ret;
+}
 
-	tmp := t.TempDir()
-	tmps1 := filepath.Join(tmp, "s1")
-	os.MkdirAll(tmps1, 0755)
-	C.tmps1 = C.CString(tmps1)
-	tmps2 := filepath.Join(tmp, "s2")
-	os.MkdirAll(tmps2, 0755)
-	C.tmps2 = C.CString(tmps2)
+// accept_queued_s2 returns how many conns wait on ln_accept to be
+// accepted, as each is sent with one byte.
+int accept_queued_s2() {
+	int n;
+	if (ioctl(ln_accept, FIONREAD, &n) != 0) {
+		return -1;
+	}
+	return n;
+}
 
-	if C.test_conn() != 0 {
-		t.Fatal(C.GoString(C.err))
+int listen_addr_s2(char* addr, tailscale_listener* ln) {
+	if (tailscale_listen(s2, "tcp", addr, ln) != 0) {
+		return set_err(s2, 'J');
 	}
+	return 0;
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+int accept_timeout_s2(int timeout_ms) {
+	tailscale_conn c;
+	int ret;
+	if ((ret = tailscale_accept_timeout(ln_accept, timeout_ms, &c)) != 0) {
+		set_err(s2, 'I');
+		return ret;
+	}
+	close(c);
+	return 0;
+}
 
-	localAPIStatus := "http://" + C.GoString(C.addr) + "/localapi/v0/status"
-	t.Logf("fetching local API status from %q", localAPIStatus)
-	req, err := http.NewRequestWithContext(ctx, "GET", localAPIStatus, nil)
-	if err != nil {
-		t.Fatal(err)
+int resolve_s1(char* name, char* buf) {
+	return tailscale_resolve(s1, name, buf, addrlen);
+}
+
+int test_getaddrinfo() {
+	struct addrinfo hints = {0};
+	hints.ai_family = AF_UNSPEC;
+	hints.ai_socktype = SOCK_STREAM;
+	hints.ai_flags = AI_CANONNAME;
+	struct addrinfo* res = NULL;
+	int ret;
+
+	if ((ret = tailscale_getaddrinfo(s1, "s2", "8082", &hints, &res)) != 0) {
+		snprintf(err, errlen, "getaddrinfo(s2): %s", gai_strerror(ret));
+		return 1;
 	}
-	req.Header.Set("Sec-Tailscale", "localapi")
-	req.SetBasicAuth("", C.GoString(C.local_api_cred))
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatal(err)
+	if (res->ai_canonname == NULL || strcmp(res->ai_canonname, "s2.tail-scale.ts.net") != 0) {
+		snprintf(err, errlen, "getaddrinfo(s2): canonname %s", res->ai_canonname);
+		return 1;
 	}
-	b, err := io.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		t.Fatal(err)
+	int n = 0;
+	for (struct addrinfo* ai = res; ai != NULL; ai = ai->ai_next) {
+		char host[64], serv[16];
+		if (getnameinfo(ai->ai_addr, ai->ai_addrlen, host, sizeof(host), serv, sizeof(serv), NI_NUMERICHOST|NI_NUMERICSERV) != 0) {
+			snprintf(err, errlen, "getnameinfo failed");
+			return 1;
+		}
+		if (ai->ai_socktype != SOCK_STREAM || strcmp(serv, "8082") != 0 || strstr(ips2, host) == NULL) {
+			snprintf(err, errlen, "getaddrinfo(s2): unexpected entry %s port %s socktype %d", host, serv, ai->ai_socktype);
+			return 1;
+		}
+		n++;
 	}
-	if res.StatusCode != 200 {
-		t.Errorf("/status: %d: %s", res.StatusCode, b)
+	tailscale_freeaddrinfo(res);
+	if (n != 2) {
+		snprintf(err, errlen, "getaddrinfo(s2): got %d entries, want 2", n);
+		return 1;
 	}
 
-	if C.close_conn() != 0 {
-		t.Fatal(C.GoString(C.err))
+	hints.ai_family = AF_INET;
+	if ((ret = tailscale_getaddrinfo(s1, "s2.tail-scale.ts.net", NULL, &hints, &res)) != 0) {
+		snprintf(err, errlen, "getaddrinfo(s2.tail-scale.ts.net, AF_INET): %s", gai_strerror(ret));
+		return 1;
+	}
+	if (res->ai_family != AF_INET || res->ai_next != NULL) {
+		snprintf(err, errlen, "getaddrinfo(s2.tail-scale.ts.net, AF_INET): want one AF_INET entry");
+		return 1;
+	}
+	tailscale_freeaddrinfo(res);
+
+	if ((ret = tailscale_getaddrinfo(s1, "nosuchhost.tail-scale.ts.net", NULL, &hints, &res)) != EAI_NONAME) {
+		snprintf(err, errlen, "getaddrinfo(nosuchhost.tail-scale.ts.net) = %d, want EAI_NONAME", ret);
+		return 1;
+	}
+
+	hints.ai_flags = 0;
+	if ((ret = tailscale_getaddrinfo(s1, "localhost", "80", &hints, &res)) != 0) {
+		snprintf(err, errlen, "getaddrinfo(localhost): %s", gai_strerror(ret));
+		return 1;
+	}
+	tailscale_freeaddrinfo(res);
+	return 0;
+}
+
+int dns_server_s1(char* listen_addr) {
+	if (tailscale_dns_server(s1, listen_addr) != 0) {
+		return set_err(s1, 'm');
+	}
+	return 0;
+}
+
+int ping_s1(char* target, char* type, char* buf, size_t buflen) {
+	return tailscale_ping(s1, target, type, 5000, buf, buflen);
+}
+
+int wait_peer_s1(char* target, int timeout_ms) {
+	return tailscale_wait_peer(s1, target, timeout_ms);
+}
+
+int watch_peers_s1(char* filter, int* fd) {
+	return tailscale_watch_peers(s1, filter, fd);
+}
+
+tailscale_listener ln_tag;
+
+int listen_tag_s2() {
+	if (tailscale_listen(s2, "tcp", ":8086", &ln_tag) != 0) {
+		return set_err(s2, 'E');
+	}
+	return 0;
+}
+
+// dial_tag_s1 connects to a peer tagged tag on port 8086, which must be
+// s2, and checks the connection works.
+int dial_tag_s1(char* tag, char* policy) {
+	tailscale_conn c, r;
+	int ret;
+	if ((ret = tailscale_dial_tag(s1, "tcp", tag, 8086, policy, &c)) != 0) {
+		set_err(s1, 'E');
+		return ret;
+	}
+	if (tailscale_accept(ln_tag, &r) != 0) {
+		close(c);
+		return set_err(s2, 'E');
+	}
+	ret = 0;
+	char got[3] = {0};
+	if (write(c, "hi", 2) != 2 || read(r, got, 2) != 2 || strcmp(got, "hi") != 0) {
+		snprintf(err, errlen, "dial_tag(%s, %s): echo failed: %s", tag, policy, strerror(errno));
+		ret = 1;
+	}
+	close(c);
+	close(r);
+	return ret;
+}
+
+tailscale_listener ln_verified;
+
+int listen_verified_s2() {
+	if (tailscale_listen(s2, "tcp", ":8087", &ln_verified) != 0) {
+		return set_err(s2, 'F');
+	}
+	return 0;
+}
+
+// dial_verified_s1 connects to s2 expecting the peer expected, and
+// checks the connection works.
+int dial_verified_s1(char* expected) {
+	tailscale_conn c, r;
+	int ret;
+	if ((ret = tailscale_dial_verified(s1, "tcp", "s2:8087", expected, &c)) != 0) {
+		set_err(s1, 'F');
+		return ret;
+	}
+	if (tailscale_accept(ln_verified, &r) != 0) {
+		close(c);
+		return set_err(s2, 'F');
+	}
+	ret = 0;
+	char got[3] = {0};
+	if (write(c, "hi", 2) != 2 || read(r, got, 2) != 2 || strcmp(got, "hi") != 0) {
+		snprintf(err, errlen, "dial_verified(%s): echo failed: %s", expected, strerror(errno));
+		ret = 1;
+	}
+	close(c);
+	close(r);
+	return ret;
+}
+
+tailscale_listener ln_tls;
+
+int listen_tls_s2() {
+	if (tailscale_listen(s2, "tcp", ":8443", &ln_tls) != 0) {
+		return set_err(s2, 'G');
+	}
+	return 0;
+}
+
+int accept_tls_s2(tailscale_conn* conn) {
+	if (tailscale_accept(ln_tls, conn) != 0) {
+		return set_err(s2, 'G');
+	}
+	return 0;
+}
+
+int dial_tls_s1(char* addr, tailscale_conn* conn) {
+	int ret;
+	if ((ret = tailscale_dial_tls(s1, addr, conn)) != 0) {
+		set_err(s1, 'G');
+	}
+	return ret;
+}
+
+// s3 is a server that is never explicitly started, for calls that
+// must start it themselves.
+tailscale s3;
+
+int new_s3(char* dir, char* url) {
+	s3 = tailscale_new();
+	if (tailscale_set_control_url(s3, url) != 0 ||
+		tailscale_set_dir(s3, dir) != 0 ||
+		tailscale_set_hostname(s3, "s3") != 0 ||
+		tailscale_set_logfd(s3, -1) != 0) {
+		return set_err(s3, 'K');
+	}
+	return 0;
+}
+
+int dial_tls_s3(char* addr, tailscale_conn* conn) {
+	int ret;
+	if ((ret = tailscale_dial_tls(s3, addr, conn)) != 0) {
+		set_err(s3, 'K');
+	}
+	return ret;
+}
+
+int up_s3() {
+	int ret;
+	if ((ret = tailscale_up(s3)) != 0) {
+		set_err(s3, 'K');
+	}
+	return ret;
+}
+
+int reauth_s3(char* authkey) {
+	int ret;
+	if ((ret = tailscale_reauth(s3, authkey)) != 0) {
+		set_err(s3, 'K');
+	}
+	return ret;
+}
+
+int close_s3() {
+	if (tailscale_close(s3) != 0) {
+		return set_err(s3, 'K');
+	}
+	return 0;
+}
+
+int dial_s1(char* network, char* addr) {
+	tailscale_conn c;
+	int ret;
+	if ((ret = tailscale_dial(s1, network, addr, &c)) != 0) {
+		set_err(s1, 'H');
+		return ret;
+	}
+	close(c);
+	return 0;
+}
+
+int dial_conn_s1(char* network, char* addr, tailscale_conn* conn) {
+	if (tailscale_dial_timeout(s1, network, addr, 10000, conn) != 0) {
+		return set_err(s1, 'H');
+	}
+	return 0;
+}
+
+int dial_timeout_s1(char* network, char* addr, int timeout_ms) {
+	tailscale_conn c;
+	int ret;
+	if ((ret = tailscale_dial_timeout(s1, network, addr, timeout_ms, &c)) != 0) {
+		set_err(s1, 'H');
+		return ret;
+	}
+	close(c);
+	return 0;
+}
+
+int dial_async_s1(char* network, char* addr, tailscale_conn* conn) {
+	int ret;
+	if ((ret = tailscale_dial_async(s1, network, addr, conn)) != EINPROGRESS) {
+		set_err(s1, 'I');
+	}
+	return ret;
+}
+
+// poll_writable returns 1 if fd polls as writable within timeout_ms.
+int poll_writable(int fd, int timeout_ms) {
+	struct pollfd pfd = { .fd = fd, .events = POLLOUT };
+	return poll(&pfd, 1, timeout_ms);
+}
+
+int netcheck_s1(char* buf, size_t buflen) {
+	if (tailscale_netcheck(s1, buf, buflen) != 0) {
+		return set_err(s1, 'n');
+	}
+	return 0;
+}
+
+int list_exit_nodes_s1(char* buf, size_t buflen) {
+	if (tailscale_list_exit_nodes(s1, buf, buflen) != 0) {
+		return set_err(s1, 'o');
+	}
+	return 0;
+}
+
+int suggest_exit_node_s1(char* buf, size_t buflen) {
+	if (tailscale_suggest_exit_node(s1, buf, buflen) != 0) {
+		return set_err(s1, 'p');
+	}
+	return 0;
+}
+
+int set_exit_node_s1(char* node) {
+	if (tailscale_set_exit_node(s1, node, 1) != 0) {
+		return set_err(s1, 'q');
+	}
+	return 0;
+}
+
+int prefs_get_s1(char* buf, size_t buflen) {
+	if (tailscale_prefs_get_json(s1, buf, buflen) != 0) {
+		return set_err(s1, 'r');
+	}
+	return 0;
+}
+
+int prefs_edit_s1(char* json) {
+	if (tailscale_prefs_edit_json(s1, json) != 0) {
+		return set_err(s1, 's');
+	}
+	return 0;
+}
+
+int prefs_edit_s2(char* json) {
+	if (tailscale_prefs_edit_json(s2, json) != 0) {
+		return set_err(s2, 's');
+	}
+	return 0;
+}
+
+int set_hostname_s2(char* hostname) {
+	if (tailscale_set_hostname(s2, hostname) != 0) {
+		return set_err(s2, 't');
+	}
+	return 0;
+}
+
+int self_s1(char* buf, size_t buflen) {
+	if (tailscale_self_json(s1, buf, buflen) != 0) {
+		return set_err(s1, 'D');
+	}
+	return 0;
+}
+
+int rotate_loopback() {
+	if (tailscale_loopback_rotate(s1, proxy_cred, local_api_cred) != 0) {
+		return set_err(s1, 'f');
+	}
+	return 0;
+}
+
+int stop_loopback() {
+	if (tailscale_loopback_stop(s1) != 0) {
+		return set_err(s1, 'g');
+	}
+	return 0;
+}
+
+int reauth_s2() {
+	int ret;
+	tailscale_listener ln;
+	if ((ret = tailscale_listen(s2, "tcp", ":8083", &ln)) != 0) {
+		return set_err(s2, 'w');
+	}
+	if ((ret = tailscale_reauth(s2, "tskey-reauth")) != 0) {
+		return set_err(s2, 'w');
+	}
+
+	// The listener opened before tailscale_reauth still works.
+	char target[128];
+	char* comma = strchr(ips2, ',');
+	snprintf(target, sizeof(target), "%.*s:8083", comma ? (int)(comma - ips2) : (int)strlen(ips2), ips2);
+	tailscale_conn c, r;
+	if ((ret = tailscale_dial(s1, "tcp", target, &c)) != 0) {
+		return set_err(s1, 'x');
+	}
+	if ((ret = tailscale_accept(ln, &r)) != 0) {
+		return set_err(s2, 'x');
+	}
+	close(c);
+	close(r);
+	close(ln);
+	return 0;
+}
+
+int logout_s2() {
+	int ret;
+	if ((ret = tailscale_logout(s2)) != 0) {
+		return set_err(s2, 'u');
+	}
+	if ((ret = tailscale_resolve(s2, "s1", addr, addrlen)) != EAI_AGAIN) {
+		snprintf(err, errlen, "resolve after logout = %d, want EAI_AGAIN", ret);
+		return 1;
+	}
+	if ((ret = tailscale_self_json(s2, addr, addrlen)) != ENOTCONN) {
+		snprintf(err, errlen, "self_json after logout = %d (%s), want ENOTCONN", ret, addr);
+		return 1;
+	}
+	if ((ret = tailscale_up(s2)) != 0) {
+		return set_err(s2, 'v');
+	}
+	if ((ret = tailscale_resolve(s2, "s1", addr, addrlen)) != 0) {
+		return set_err(s2, 'v');
+	}
+	// The old node key is gone, so s2 registered as a new node.
+	char* ips = calloc(addrlen, 1);
+	if ((ret = tailscale_getips(s2, ips, addrlen)) != 0) {
+		return set_err(s2, 'v');
+	}
+	if (strcmp(ips, ips2) == 0) {
+		snprintf(err, errlen, "s2 kept IPs %s after logout", ips);
+		return 1;
+	}
+	free(ips2);
+	ips2 = ips;
+	return 0;
+}
+
+// first_ip writes the first address in the tailscale_getips list ips,
+// with port appended, to buf.
+void first_ip(char* buf, size_t buflen, const char* ips, const char* port) {
+	const char* comma = strchr(ips, ',');
+	int n = comma ? (int)(comma - ips) : (int)strlen(ips);
+	snprintf(buf, buflen, "%.*s:%s", n, ips, port);
+}
+
+tailscale_listener profile_port_ln, profile_ip_ln;
+tailscale_conn profile_conn;
+
+// profiles_setup opens listeners on s2 for a port and for an address of
+// its current profile, and a connection to s2.
+int profiles_setup() {
+	char target[128];
+	tailscale_conn c;
+	if (tailscale_listen(s2, "tcp", ":8084", &profile_port_ln) != 0) {
+		return set_err(s2, 'y');
+	}
+	first_ip(target, sizeof(target), ips2, "8085");
+	if (tailscale_listen(s2, "tcp", target, &profile_ip_ln) != 0) {
+		return set_err(s2, 'y');
+	}
+	first_ip(target, sizeof(target), ips2, "8084");
+	if (tailscale_dial(s1, "tcp", target, &c) != 0) {
+		return set_err(s1, 'y');
+	}
+	if (tailscale_accept(profile_port_ln, &profile_conn) != 0) {
+		return set_err(s2, 'y');
+	}
+	close(c);
+	return 0;
+}
+
+// profiles_check_closed checks that the connection and address listener
+// from profiles_setup were closed by a profile change.
+int profiles_check_closed() {
+	char b;
+	if (read(profile_conn, &b, 1) > 0) {
+		snprintf(err, errlen, "connection open after profile change");
+		return 1;
+	}
+	close(profile_conn);
+	tailscale_conn c;
+	if (tailscale_accept(profile_ip_ln, &c) == 0) {
+		snprintf(err, errlen, "address listener open after profile change");
+		return 1;
+	}
+	close(profile_ip_ln);
+	return 0;
+}
+
+// profiles_resync sets up a new WireGuard session from s2 to s1 after a
+// profile switch. s2 lost its sessions in the switch, and s1 keeps sending
+// on its old one until it expires.
+int profiles_resync() {
+	char pong[1024];
+	if (tailscale_ping(s2, "s1", "TSMP", 5000, pong, sizeof(pong)) != 0) {
+		return set_err(s2, 'z');
+	}
+	return 0;
+}
+
+// profiles_check_port_ln checks the port listener from profiles_setup
+// accepts connections to the current addresses of s2.
+int profiles_check_port_ln() {
+	char ips[128], target[128];
+	tailscale_conn c, r;
+
+	if (profiles_resync() != 0) {
+		return 1;
+	}
+	if (tailscale_getips(s2, ips, sizeof(ips)) != 0) {
+		return set_err(s2, 'z');
+	}
+	first_ip(target, sizeof(target), ips, "8084");
+	if (tailscale_dial(s1, "tcp", target, &c) != 0) {
+		return set_err(s1, 'z');
+	}
+	if (tailscale_accept(profile_port_ln, &r) != 0) {
+		return set_err(s2, 'z');
+	}
+	close(c);
+	close(r);
+	close(profile_port_ln);
+	return 0;
+}
+
+int profiles_list_s2(char* buf, size_t buflen) {
+	if (tailscale_profiles_list(s2, buf, buflen) != 0) {
+		return set_err(s2, 'A');
+	}
+	return 0;
+}
+
+int profile_add_s2(char* authkey) {
+	if (tailscale_profile_add(s2, authkey) != 0) {
+		return set_err(s2, 'B');
+	}
+	return 0;
+}
+
+int profile_switch_s2(char* id) {
+	if (tailscale_profile_switch(s2, id) != 0) {
+		return set_err(s2, 'C');
+	}
+	return 0;
+}
+
+int close_conn() {
+	if (tailscale_close(s1) != 0) {
+		return set_err(s1, 'd');
+	}
+	if (tailscale_close(s2) != 0) {
+		return set_err(s2, 'e');
+	}
+	return 0;
+}
+*/
+import "C"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/integration"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/ptr"
+	"tailscale.com/util/dnsname"
+)
+
+var verboseDERP = flag.Bool("verbose-derp", false, "if set, print DERP and STUN logs")
+
+// RunTestConn runs the tests of the C API against two servers on a
+// test control server. setRootCAs must make tailscale_dial_tls on the
+// server sd trust the certificates in pool.
+func RunTestConn(t *testing.T, setRootCAs func(sd int, pool *x509.CertPool)) {
+	// Corp#4520: don't use netns for tests.
+	netns.SetEnabled(false)
+	t.Cleanup(func() {
+		netns.SetEnabled(true)
+	})
+
+	derpLogf := logger.Discard
+	if *verboseDERP {
+		derpLogf = t.Logf
+	}
+	derpMap := integration.RunDERPAndSTUN(t, derpLogf, "127.0.0.1")
+	control := &testcontrol.Server{
+		DERPMap:        derpMap,
+		MagicDNSDomain: "tail-scale.ts.net",
+	}
+	control.HTTPTestServer = httptest.NewUnstartedServer(control)
+	control.HTTPTestServer.Start()
+	t.Cleanup(control.HTTPTestServer.Close)
+	controlURL := control.HTTPTestServer.URL
+	t.Logf("testcontrol listening on %s", controlURL)
+
+	C.control_url = C.CString(controlURL)
+
+	tmp := t.TempDir()
+	tmps1 := filepath.Join(tmp, "s1")
+	os.MkdirAll(tmps1, 0755)
+	C.tmps1 = C.CString(tmps1)
+	tmps2 := filepath.Join(tmp, "s2")
+	os.MkdirAll(tmps2, 0755)
+	C.tmps2 = C.CString(tmps2)
+
+	if C.test_conn() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	setOnline(control)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	localAPIStatus := "http://" + C.GoString(C.addr) + "/localapi/v0/status"
+	t.Logf("fetching local API status from %q", localAPIStatus)
+	if code, b := getLocalAPI(t, ctx, localAPIStatus, C.GoString(C.local_api_cred)); code != 200 {
+		t.Errorf("/status: %d: %s", code, b)
+	}
+
+	testSelf(t)
+	testResolve(t)
+	if C.test_getaddrinfo() != 0 {
+		t.Error(C.GoString(C.err))
+	}
+	testDNSServer(t, ctx)
+	testPing(t)
+	testNetcheck(t)
+	testExitNode(t, ctx, control)
+	testWaitPeer(t)
+	testWatchPeers(t, ctx, control)
+	testDialVerified(t)
+	testDialTag(t, ctx, control)
+	testDialTLS(t, setRootCAs)
+	testCloseLogin(t)
+	testPrefs(t)
+	testSetHostname(t, ctx, control)
+	testHTTPProxyGet(t)
+	tunnel := testHTTPConnect(t)
+	defer tunnel.Close()
+	testSOCKSUDP(t)
+	testDialTimeout(t, ctx, control)
+	testDialAsync(t)
+	testAccept(t)
+	testListenerAddr(t)
+
+	oldCred := C.GoString(C.local_api_cred)
+	if C.rotate_loopback() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	if newCred := C.GoString(C.local_api_cred); newCred == oldCred || len(newCred) != 32 {
+		t.Errorf("rotated local API cred = %q, want new 32 byte cred", newCred)
+	}
+	if code, b := getLocalAPI(t, ctx, localAPIStatus, oldCred); code != http.StatusForbidden {
+		t.Errorf("/status with old cred: %d: %s", code, b)
+	}
+	if code, b := getLocalAPI(t, ctx, localAPIStatus, C.GoString(C.local_api_cred)); code != 200 {
+		t.Errorf("/status with rotated cred: %d: %s", code, b)
+	}
+
+	socks := dialSOCKS(t)
+	defer socks.Close()
+	if C.stop_loopback() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	if c, err := net.Dial("tcp", C.GoString(C.addr)); err == nil {
+		c.Close()
+		t.Errorf("loopback still accepting connections after tailscale_loopback_stop")
+	}
+	for name, c := range map[string]net.Conn{"CONNECT tunnel": tunnel, "SOCKS5 connection": socks} {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+			t.Errorf("read from %s after tailscale_loopback_stop: %v, want it closed", name, err)
+		}
+	}
+
+	testProfiles(t, control)
+	if C.reauth_s2() != 0 {
+		t.Error(C.GoString(C.err))
+	}
+	if C.logout_s2() != 0 {
+		t.Error(C.GoString(C.err))
+	}
+
+	// A wait or dial with no timeout is interrupted by tailscale_close.
+	waitDone := make(chan C.int)
+	go func() {
+		cname := C.CString("nosuchpeer")
+		defer C.free(unsafe.Pointer(cname))
+		waitDone <- C.wait_peer_s1(cname, -1)
+	}()
+	dialDone := make(chan C.int)
+	go func() {
+		cnetwork := C.CString("tcp")
+		defer C.free(unsafe.Pointer(cnetwork))
+		caddr := C.CString(unreachableAddr)
+		defer C.free(unsafe.Pointer(caddr))
+		dialDone <- C.dial_s1(cnetwork, caddr)
+	}()
+	cnetwork := C.CString("tcp")
+	defer C.free(unsafe.Pointer(cnetwork))
+	caddr := C.CString(unreachableAddr)
+	defer C.free(unsafe.Pointer(caddr))
+	var asyncConn C.tailscale_conn
+	if ret := C.dial_async_s1(cnetwork, caddr, &asyncConn); ret != C.EINPROGRESS {
+		t.Fatalf("tailscale_dial_async(%s) = %d: %s", unreachableAddr, ret, C.GoString(C.err))
+	}
+	defer C.close(asyncConn)
+	time.Sleep(100 * time.Millisecond)
+	if C.poll_writable(asyncConn, 0) != 0 {
+		t.Error("tailscale_dial_async conn writable while dialing")
+	}
+	if ret := C.tailscale_conn_error(asyncConn); ret != C.EINPROGRESS {
+		t.Errorf("tailscale_conn_error while dialing = %d, want EINPROGRESS", ret)
+	}
+
+	if C.close_conn() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	for name, done := range map[string]chan C.int{"tailscale_wait_peer": waitDone, "tailscale_dial": dialDone} {
+		select {
+		case ret := <-done:
+			if ret != C.ECANCELED {
+				t.Errorf("%s during tailscale_close = %d, want ECANCELED", name, ret)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s still blocked after tailscale_close", name)
+		}
+	}
+	if C.poll_writable(asyncConn, 5000) != 1 {
+		t.Error("tailscale_dial_async conn not writable after tailscale_close")
+	} else if ret := C.tailscale_conn_error(asyncConn); ret != C.ECANCELED {
+		t.Errorf("tailscale_conn_error after tailscale_close = %d, want ECANCELED", ret)
+	}
+}
+
+// testSelf checks the node information of s1.
+func testSelf(t *testing.T) {
+	const buflen = 4096
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	if C.self_s1(buf, buflen) != 0 {
+		t.Error(C.GoString(C.err))
+		return
+	}
+	var self struct {
+		ID             string
+		Name           string
+		HostName       string
+		MagicDNSSuffix string
+		User           string
+		TailscaleIPs   []string
+	}
+	if err := json.Unmarshal([]byte(C.GoString(buf)), &self); err != nil {
+		t.Errorf("tailscale_self_json: %v", err)
+		return
+	}
+	if self.ID == "" || self.Name != "s1.tail-scale.ts.net" || self.HostName != "s1" ||
+		self.MagicDNSSuffix != "tail-scale.ts.net" || self.User == "" || len(self.TailscaleIPs) != 2 {
+		t.Errorf("tailscale_self_json = %s", C.GoString(buf))
+	}
+}
+
+// testResolve looks up s2 by name from s1.
+func testResolve(t *testing.T) {
+	buf := (*C.char)(C.calloc(C.size_t(C.addrlen), 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	want := C.GoString(C.ips2)
+	for _, name := range []string{"s2", "s2.tail-scale.ts.net", "S2.tail-scale.ts.net."} {
+		cname := C.CString(name)
+		ret := C.resolve_s1(cname, buf)
+		C.free(unsafe.Pointer(cname))
+		if ret != 0 {
+			t.Errorf("tailscale_resolve(%q) = %d", name, ret)
+		} else if got := C.GoString(buf); got != want {
+			t.Errorf("tailscale_resolve(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	cname := C.CString("nosuchhost")
+	defer C.free(unsafe.Pointer(cname))
+	if ret := C.resolve_s1(cname, buf); ret != C.EAI_NONAME {
+		t.Errorf("tailscale_resolve(nosuchhost) = %d, want EAI_NONAME", ret)
+	}
+}
+
+// testPing pings s2 from s1.
+func testPing(t *testing.T) {
+	const buflen = 1024
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	ctarget := C.CString("s2")
+	defer C.free(unsafe.Pointer(ctarget))
+	for _, typ := range []string{"disco", "TSMP", "ICMP"} {
+		ctyp := C.CString(typ)
+		ret := C.ping_s1(ctarget, ctyp, buf, buflen)
+		C.free(unsafe.Pointer(ctyp))
+		if ret != 0 {
+			t.Errorf("tailscale_ping(s2, %s) = %d", typ, ret)
+			continue
+		}
+		var res struct {
+			NodeName       string
+			Type           string
+			LatencySeconds float64
+		}
+		if err := json.Unmarshal([]byte(C.GoString(buf)), &res); err != nil {
+			t.Errorf("tailscale_ping(s2, %s): %v", typ, err)
+			continue
+		}
+		if res.NodeName != "s2" || res.Type != typ || res.LatencySeconds <= 0 {
+			t.Errorf("tailscale_ping(s2, %s) = %s", typ, C.GoString(buf))
+		}
+	}
+
+	ctyp := C.CString("carrier-pigeon")
+	defer C.free(unsafe.Pointer(ctyp))
+	if ret := C.ping_s1(ctarget, ctyp, buf, buflen); ret != C.EINVAL {
+		t.Errorf("tailscale_ping(s2, carrier-pigeon) = %d, want EINVAL", ret)
+	}
+}
+
+// testWaitPeer waits for s2, which is already online, from s1.
+func testWaitPeer(t *testing.T) {
+	for _, target := range []string{"s2", "s2.tail-scale.ts.net", strings.Split(C.GoString(C.ips2), ",")[0]} {
+		ctarget := C.CString(target)
+		ret := C.wait_peer_s1(ctarget, 5000)
+		C.free(unsafe.Pointer(ctarget))
+		if ret != 0 {
+			t.Errorf("tailscale_wait_peer(%q) = %d", target, ret)
+		}
+	}
+
+	for _, tt := range []struct {
+		target  string
+		timeout C.int
+		want    C.int
+	}{
+		{"nosuchpeer", 100, C.ETIMEDOUT},
+		{"s1", 100, C.ETIMEDOUT}, // not a peer of itself
+		{"s2", 0, C.EINVAL},
+		{"", 100, C.EINVAL},
+	} {
+		ctarget := C.CString(tt.target)
+		ret := C.wait_peer_s1(ctarget, tt.timeout)
+		C.free(unsafe.Pointer(ctarget))
+		if ret != tt.want {
+			t.Errorf("tailscale_wait_peer(%q, %d) = %d, want %d", tt.target, tt.timeout, ret, tt.want)
+		}
+	}
+}
+
+// testWatchPeers watches s2 from s1 as it is renamed.
+func testWatchPeers(t *testing.T, ctx context.Context, control *testcontrol.Server) {
+	defer renameNodes(ctx, control, nil)()
+
+	watch := func(filter string) (*bufio.Scanner, func()) {
+		cfilter := C.CString(filter)
+		defer C.free(unsafe.Pointer(cfilter))
+		var fd C.int
+		if ret := C.watch_peers_s1(cfilter, &fd); ret != 0 {
+			t.Fatalf("tailscale_watch_peers(%q) = %d", filter, ret)
+		}
+		syscall.SetNonblock(int(fd), true)
+		f := os.NewFile(uintptr(fd), "watch_peers")
+		f.SetReadDeadline(time.Now().Add(10 * time.Second))
+		return bufio.NewScanner(f), func() { f.Close() }
+	}
+	type event struct {
+		Event string
+		Peer  struct {
+			Name     string
+			HostName string
+			Online   bool
+		}
+	}
+	// next returns the next event from sc, or fails the test.
+	next := func(sc *bufio.Scanner) (ev event) {
+		t.Helper()
+		if !sc.Scan() {
+			t.Fatalf("no event: %v", sc.Err())
+		}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("bad event %q: %v", sc.Text(), err)
+		}
+		return ev
+	}
+
+	all, closeAll := watch("")
+	defer closeAll()
+	byName, closeByName := watch("S?")
+	defer closeByName()
+
+	for _, sc := range []*bufio.Scanner{all, byName} {
+		if ev := next(sc); ev.Event != "added" || ev.Peer.HostName != "s2" || !ev.Peer.Online {
+			t.Errorf("first event = %+v, want s2 added", ev)
+		}
+	}
+
+	cname := C.CString("s2-watched")
+	defer C.free(unsafe.Pointer(cname))
+	if C.set_hostname_s2(cname) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	// The new hostname and MagicDNS name may arrive in one netmap or
+	// two, so skip any event for the hostname alone.
+	nextName := func(sc *bufio.Scanner, name string) event {
+		t.Helper()
+		for {
+			ev := next(sc)
+			if ev.Event != "changed" || strings.HasPrefix(ev.Peer.Name, name+".") {
+				return ev
+			}
+		}
+	}
+	if ev := nextName(all, "s2-watched"); ev.Event != "changed" || ev.Peer.HostName != "s2-watched" {
+		t.Errorf("event after rename = %+v, want s2-watched changed", ev)
+	}
+	if ev := nextName(byName, "s2-watched"); ev.Event != "removed" {
+		t.Errorf("event for S? after rename = %+v, want s2 removed", ev)
+	}
+	cname2 := C.CString("s2")
+	defer C.free(unsafe.Pointer(cname2))
+	if C.set_hostname_s2(cname2) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	if ev := nextName(all, "s2"); ev.Event != "changed" || ev.Peer.HostName != "s2" {
+		t.Errorf("event after renaming back = %+v, want s2 changed", ev)
+	}
+	if ev := nextName(byName, "s2"); ev.Event != "added" || ev.Peer.HostName != "s2" {
+		t.Errorf("event for S? after renaming back = %+v, want s2 added", ev)
+	}
+
+	cfilter := C.CString("[")
+	defer C.free(unsafe.Pointer(cfilter))
+	var fd C.int
+	if ret := C.watch_peers_s1(cfilter, &fd); ret != C.EINVAL {
+		t.Errorf("tailscale_watch_peers([) = %d, want EINVAL", ret)
+	}
+}
+
+// testDialVerified dials s2 from s1, checking its identity.
+func testDialVerified(t *testing.T) {
+	const buflen = 4096
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+	if C.tailscale_self_json(C.s2, buf, buflen) != 0 {
+		t.Fatal("tailscale_self_json(s2) failed")
+	}
+	var s2 struct {
+		ID   string
+		User string
+	}
+	if err := json.Unmarshal([]byte(C.GoString(buf)), &s2); err != nil {
+		t.Fatal(err)
+	}
+
+	if C.listen_verified_s2() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	defer C.close(C.ln_verified)
+
+	for _, tt := range []struct {
+		expected string
+		want     C.int
+	}{
+		{fmt.Sprintf(`{"ID":%q}`, s2.ID), 0},
+		{fmt.Sprintf(`{"User":%q}`, strings.ToUpper(s2.User)), 0},
+		{fmt.Sprintf(`{"ID":%q,"User":%q}`, s2.ID, s2.User), 0},
+		{`{"ID":"nosuchnode"}`, C.EPERM},
+		{`{"User":"nobody@example.com"}`, C.EPERM},
+		{fmt.Sprintf(`{"ID":%q,"Tag":"tag:api"}`, s2.ID), C.EPERM},
+		{`{}`, C.EINVAL},
+		{`{"Name":"s2"}`, C.EINVAL},
+		{`not json`, C.EINVAL},
+	} {
+		cexpected := C.CString(tt.expected)
+		ret := C.dial_verified_s1(cexpected)
+		C.free(unsafe.Pointer(cexpected))
+		if ret != tt.want {
+			t.Errorf("tailscale_dial_verified(%s) = %d, want %d: %s", tt.expected, ret, tt.want, C.GoString(C.err))
+		}
+	}
+}
+
+// testDialTag tags s2 and dials it by tag from s1.
+func testDialTag(t *testing.T, ctx context.Context, control *testcontrol.Server) {
+	var s1Key, s2Key key.NodePublic
+	for _, n := range control.AllNodes() {
+		switch n.Hostinfo.Hostname() {
+		case "s1":
+			s1Key = n.Key
+		case "s2":
+			s2Key = n.Key
+		}
+	}
+	setTags := func(tags ...string) {
+		n := control.Node(s2Key)
+		n.Tags = tags
+		control.UpdateNode(n)
+		if err := control.ForceNetmapUpdate(ctx, s1Key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setTags("tag:api")
+	defer setTags()
+
+	if C.listen_tag_s2() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	defer C.close(C.ln_tag)
+
+	ctag := C.CString("tag:api")
+	defer C.free(unsafe.Pointer(ctag))
+	for _, policy := range []string{"", "round-robin", "random", "lowest-latency"} {
+		cpolicy := C.CString(policy)
+		ret := C.dial_tag_s1(ctag, cpolicy)
+		for ret == C.ENOENT && ctx.Err() == nil {
+			// s1 has not seen the tag yet.
+			time.Sleep(10 * time.Millisecond)
+			ret = C.dial_tag_s1(ctag, cpolicy)
+		}
+		C.free(unsafe.Pointer(cpolicy))
+		if ret != 0 {
+			t.Errorf("tailscale_dial_tag(tag:api, %q) = %d: %s", policy, ret, C.GoString(C.err))
+		}
+	}
+
+	for _, tt := range []struct {
+		tag, policy string
+		want        C.int
+	}{
+		{"tag:nosuch", "random", C.ENOENT},
+		{"api", "random", C.EINVAL},
+		{"tag:api", "fastest", C.EINVAL},
+	} {
+		ctag := C.CString(tt.tag)
+		cpolicy := C.CString(tt.policy)
+		if ret := C.dial_tag_s1(ctag, cpolicy); ret != tt.want {
+			t.Errorf("tailscale_dial_tag(%s, %s) = %d, want %d", tt.tag, tt.policy, ret, tt.want)
+		}
+		C.free(unsafe.Pointer(ctag))
+		C.free(unsafe.Pointer(cpolicy))
+	}
+}
+
+// testCA is the certificate authority that issues the certificates s2
+// serves in testDialTLS.
+var testCA struct {
+	once sync.Once
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// rootCAs returns a pool holding the certificate authority of the
+// certificates s2 serves over TLS, which tailscale_dial_tls must trust.
+func rootCAs() *x509.CertPool {
+	testCA.once.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "libtailscale test CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			panic(err)
+		}
+		testCA.cert, err = x509.ParseCertificate(der)
+		if err != nil {
+			panic(err)
+		}
+		testCA.key = key
+	})
+	pool := x509.NewCertPool()
+	pool.AddCert(testCA.cert)
+	return pool
+}
+
+// serverCert returns a certificate for name issued by the CA of rootCAs.
+func serverCert(t *testing.T, name string) tls.Certificate {
+	rootCAs()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, testCA.cert, &key.PublicKey, testCA.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testDialTLS dials s2 over TLS from s1, checking the certificate name
+// it requires, and from s3, which tailscale_dial_tls must start.
+func testDialTLS(t *testing.T, setRootCAs func(sd int, pool *x509.CertPool)) {
+	setRootCAs(int(C.s1), rootCAs())
+	if C.listen_tls_s2() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	defer C.close(C.ln_tls)
+
+	// serve serves one TLS connection on s2 with a certificate for
+	// certName, echoing the first message with "ok".
+	serve := func(certName string) <-chan error {
+		srvErr := make(chan error, 1)
+		go func() {
+			var fd C.int
+			if C.accept_tls_s2(&fd) != 0 {
+				srvErr <- errors.New(C.GoString(C.err))
+				return
+			}
+			f := os.NewFile(uintptr(fd), "tls")
+			nc, err := net.FileConn(f)
+			f.Close()
+			if err != nil {
+				srvErr <- err
+				return
+			}
+			defer nc.Close()
+			tc := tls.Server(nc, &tls.Config{Certificates: []tls.Certificate{serverCert(t, certName)}})
+			var b [2]byte
+			if _, err := io.ReadFull(tc, b[:]); err != nil {
+				srvErr <- err
+				return
+			}
+			_, err = tc.Write([]byte("ok"))
+			srvErr <- err
+		}()
+		return srvErr
+	}
+	// check talks to the server over the client side of a connection
+	// from tailscale_dial_tls.
+	check := func(addr string, fd C.int, srvErr <-chan error) {
+		c := os.NewFile(uintptr(fd), "tls-client")
+		var b [2]byte
+		if _, err := c.Write([]byte("hi")); err != nil {
+			t.Errorf("write to %s: %v", addr, err)
+		} else if _, err := io.ReadFull(c, b[:]); err != nil || string(b[:]) != "ok" {
+			t.Errorf("read from %s = %q, %v; want ok", addr, b, err)
+		}
+		c.Close()
+		if err := <-srvErr; err != nil {
+			t.Errorf("TLS server for %s: %v", addr, err)
+		}
+	}
+
+	ip2, _, _ := strings.Cut(C.GoString(C.ips2), ",")
+	for _, tt := range []struct {
+		addr     string
+		certName string
+		want     C.int
+	}{
+		{"s2:8443", "s2.tail-scale.ts.net", 0},
+		{ip2 + ":8443", "s2.tail-scale.ts.net", 0},
+		{"s2.tail-scale.ts.net:8443", "s2", C.EPERM},
+		{"s2:8443", "s1.tail-scale.ts.net", C.EPERM},
+	} {
+		srvErr := serve(tt.certName)
+		caddr := C.CString(tt.addr)
+		var fd C.int
+		ret := C.dial_tls_s1(caddr, &fd)
+		C.free(unsafe.Pointer(caddr))
+		if ret != tt.want {
+			t.Errorf("tailscale_dial_tls(%s) with certificate for %s = %d, want %d: %s", tt.addr, tt.certName, ret, tt.want, C.GoString(C.err))
+		}
+		if ret != 0 {
+			<-srvErr // handshake failed
+			continue
+		}
+		check(tt.addr, fd, srvErr)
+	}
+
+	// A server that has not started yet still checks for the peer's
+	// full MagicDNS name.
+	cdir := C.CString(t.TempDir())
+	defer C.free(unsafe.Pointer(cdir))
+	if C.new_s3(cdir, C.control_url) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	defer C.close_s3()
+	setRootCAs(int(C.s3), rootCAs())
+	srvErr := serve("s2.tail-scale.ts.net")
+	caddr := C.CString("s2:8443")
+	defer C.free(unsafe.Pointer(caddr))
+	var fd C.int
+	if ret := C.dial_tls_s3(caddr, &fd); ret != 0 {
+		t.Errorf("tailscale_dial_tls(s2:8443) before start = %d: %s", ret, C.GoString(C.err))
+		<-srvErr
+		return
+	}
+	check("s2:8443", fd, srvErr)
+}
+
+// testCloseLogin checks that tailscale_close interrupts tailscale_up and
+// tailscale_reauth on a server whose control server is down.
+func testCloseLogin(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	curl := C.CString(down.URL)
+	defer C.free(unsafe.Pointer(curl))
+
+	for name, login := range map[string]func() C.int{
+		"tailscale_up": func() C.int { return C.up_s3() },
+		"tailscale_reauth": func() C.int {
+			ckey := C.CString("tskey-down")
+			defer C.free(unsafe.Pointer(ckey))
+			return C.reauth_s3(ckey)
+		},
+	} {
+		cdir := C.CString(t.TempDir())
+		ret := C.new_s3(cdir, curl)
+		C.free(unsafe.Pointer(cdir))
+		if ret != 0 {
+			t.Fatal(C.GoString(C.err))
+		}
+		done := make(chan C.int, 1)
+		go func() { done <- login() }()
+		select {
+		case ret := <-done:
+			t.Errorf("%s with control server down = %d, want it to block", name, ret)
+		case <-time.After(500 * time.Millisecond):
+		}
+		if C.close_s3() != 0 {
+			t.Error(C.GoString(C.err))
+		}
+		select {
+		case ret := <-done:
+			if ret != C.ECANCELED {
+				t.Errorf("%s during tailscale_close = %d, want ECANCELED", name, ret)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s still blocked after tailscale_close", name)
+		}
+	}
+}
+
+// unreachableAddr is set by testDialTimeout to the address of a peer of
+// s1 that never answers, so that dialing it blocks until the dial times
+// out or is canceled.
+var unreachableAddr string
+
+// testDialTimeout dials from s1 with a timeout.
+func testDialTimeout(t *testing.T, ctx context.Context, control *testcontrol.Server) {
+	// testcontrol's fake nodes have no endpoints, and no DERP region.
+	// They have no Hostinfo either, which LocalBackend.Status needs.
+	control.AddFakeNode()
+	var s1Key key.NodePublic
+	for _, n := range control.AllNodes() {
+		switch {
+		case !n.Hostinfo.Valid():
+			n.Name = "unreachable.tail-scale.ts.net."
+			n.Hostinfo = (&tailcfg.Hostinfo{Hostname: "unreachable"}).View()
+			n.Online = ptr.To(true)
+			control.UpdateNode(n)
+			unreachableAddr = netip.AddrPortFrom(n.Addresses[0].Addr(), 80).String()
+		case n.Hostinfo.Hostname() == "s1":
+			s1Key = n.Key
+		}
+	}
+	if err := control.ForceNetmapUpdate(ctx, s1Key); err != nil {
+		t.Fatal(err)
+	}
+	cname := C.CString("unreachable")
+	defer C.free(unsafe.Pointer(cname))
+	if ret := C.wait_peer_s1(cname, 5000); ret != 0 {
+		t.Fatalf("tailscale_wait_peer(fake node) = %d", ret)
+	}
+
+	for _, tt := range []struct {
+		network, addr string
+		timeout       C.int
+		want          C.int
+	}{
+		{"udp", "s2:9999", 5000, 0},
+		{"tcp", unreachableAddr, 100, C.ETIMEDOUT},
+		{"tcp", "s2:9999", 0, C.EINVAL},
+	} {
+		cnetwork := C.CString(tt.network)
+		caddr := C.CString(tt.addr)
+		start := time.Now()
+		ret := C.dial_timeout_s1(cnetwork, caddr, tt.timeout)
+		C.free(unsafe.Pointer(cnetwork))
+		C.free(unsafe.Pointer(caddr))
+		if ret != tt.want {
+			t.Errorf("tailscale_dial_timeout(%s, %s, %d) = %d, want %d: %s", tt.network, tt.addr, tt.timeout, ret, tt.want, C.GoString(C.err))
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("tailscale_dial_timeout(%s, %s, %d) took %v", tt.network, tt.addr, tt.timeout, d)
+		}
+	}
+}
+
+// testDialAsync checks that a tailscale_dial_async conn polls as
+// writable once the dial completes, and that tailscale_conn_error then
+// reports the result.
+func testDialAsync(t *testing.T) {
+	if ret := C.tailscale_conn_error(-1); ret != C.EBADF {
+		t.Errorf("tailscale_conn_error(-1) = %d, want EBADF", ret)
+	}
+	for _, tt := range []struct {
+		network, addr string
+		ok            bool
+	}{
+		{"udp", "s2:9999", true},
+		{"tcp", "s2:9999", false}, // nothing listening
+	} {
+		cnetwork := C.CString(tt.network)
+		caddr := C.CString(tt.addr)
+		var c C.tailscale_conn
+		ret := C.dial_async_s1(cnetwork, caddr, &c)
+		C.free(unsafe.Pointer(cnetwork))
+		C.free(unsafe.Pointer(caddr))
+		if ret != C.EINPROGRESS {
+			t.Errorf("tailscale_dial_async(%s, %s) = %d, want EINPROGRESS: %s", tt.network, tt.addr, ret, C.GoString(C.err))
+			continue
+		}
+		if C.poll_writable(c, 5000) != 1 {
+			t.Errorf("tailscale_dial_async(%s, %s): conn not writable after 5s", tt.network, tt.addr)
+		}
+		ret = C.tailscale_conn_error(c)
+		var b [1]byte
+		switch {
+		case tt.ok && ret != 0:
+			t.Errorf("tailscale_conn_error(%s, %s) = %d, want 0", tt.network, tt.addr, ret)
+		case tt.ok && C.write(c, unsafe.Pointer(&b[0]), 1) != 1:
+			t.Errorf("tailscale_dial_async(%s, %s): write failed", tt.network, tt.addr)
+		case !tt.ok && (ret == 0 || ret == C.EINPROGRESS):
+			t.Errorf("tailscale_conn_error(%s, %s) = %d, want failure", tt.network, tt.addr, ret)
+		case !tt.ok && C.read(c, unsafe.Pointer(&b[0]), 1) != 0:
+			t.Errorf("tailscale_dial_async(%s, %s): read of failed conn did not return EOF", tt.network, tt.addr)
+		}
+		C.close(c)
+	}
+}
+
+// testAccept checks tailscale_accept_flags and tailscale_accept_timeout
+// with and without a connection waiting.
+func testAccept(t *testing.T) {
+	if C.listen_accept_s2() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+
+	if ret := C.accept_flags_s2(C.TAILSCALE_ACCEPT_NONBLOCK); ret != C.EAGAIN {
+		t.Errorf("tailscale_accept_flags(NONBLOCK) with no connection = %d, want EAGAIN", ret)
+	}
+	if ret := C.accept_flags_s2(2); ret != C.EINVAL {
+		t.Errorf("tailscale_accept_flags(2) = %d, want EINVAL", ret)
+	}
+	if ret := C.accept_timeout_s2(0); ret != C.EINVAL {
+		t.Errorf("tailscale_accept_timeout(0) = %d, want EINVAL", ret)
+	}
+	start := time.Now()
+	if ret := C.accept_timeout_s2(100); ret != C.ETIMEDOUT {
+		t.Errorf("tailscale_accept_timeout(100) with no connection = %d, want ETIMEDOUT", ret)
+	} else if d := time.Since(start); d < 90*time.Millisecond || d > 5*time.Second {
+		t.Errorf("tailscale_accept_timeout(100) took %v", d)
+	}
+
+	cnetwork := C.CString("tcp")
+	defer C.free(unsafe.Pointer(cnetwork))
+	caddr := C.CString("s2:8088")
+	defer C.free(unsafe.Pointer(caddr))
+
+	if C.dial_s1(cnetwork, caddr) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	if ret := C.accept_timeout_s2(5000); ret != 0 {
+		t.Errorf("tailscale_accept_timeout(5000) = %d: %s", ret, C.GoString(C.err))
+	}
+
+	if C.dial_s1(cnetwork, caddr) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	ret := C.accept_flags_s2(C.TAILSCALE_ACCEPT_NONBLOCK)
+	for deadline := time.Now().Add(5 * time.Second); ret == C.EAGAIN && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		ret = C.accept_flags_s2(C.TAILSCALE_ACCEPT_NONBLOCK)
+	}
+	if ret != 0 {
+		t.Errorf("tailscale_accept_flags(NONBLOCK) = %d: %s", ret, C.GoString(C.err))
+	}
+
+	// tailscale_listener_close frees the address before returning, so
+	// it can be listened on again at once.
+	oldLn := C.ln_accept
+	if ret := C.listener_close_s2(); ret != 0 {
+		t.Fatalf("tailscale_listener_close = %d: %s", ret, C.GoString(C.err))
+	}
+	if ret := C.accept_flags_s2(C.TAILSCALE_ACCEPT_NONBLOCK); ret != C.EBADF {
+		t.Errorf("tailscale_accept_flags after tailscale_listener_close = %d, want EBADF", ret)
+	}
+	if C.listen_accept_s2() != 0 {
+		t.Fatalf("listen after tailscale_listener_close: %s", C.GoString(C.err))
+	}
+	if C.ln_accept != oldLn {
+		if ret := C.tailscale_listener_close(oldLn); ret != C.EBADF {
+			t.Errorf("second tailscale_listener_close = %d, want EBADF", ret)
+		}
+	}
+
+	// Of two concurrent calls to tailscale_listener_close, only one
+	// closes the listener.
+	ln := C.ln_accept
+	rets := make(chan C.int, 2)
+	for range 2 {
+		go func() { rets <- C.tailscale_listener_close(ln) }()
+	}
+	if r1, r2 := <-rets, <-rets; min(r1, r2) != 0 || max(r1, r2) != C.EBADF {
+		t.Errorf("concurrent tailscale_listener_close = %d, %d; want 0 and EBADF", r1, r2)
+	}
+
+	// tailscale_listener_close returns even when C has stopped
+	// accepting and the listener's backlog is full. Dial until a conn
+	// is not queued, as sending it to C blocks.
+	if C.listen_accept_s2() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	for n := 1; ; n++ {
+		if n > 1000 {
+			t.Fatal("listener backlog never filled")
+		}
+		if C.dial_s1(cnetwork, caddr) != 0 {
+			t.Fatal(C.GoString(C.err))
+		}
+		queued := false
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if queued = C.accept_queued_s2() >= C.int(n); queued {
+				break
+			}
+		}
+		if !queued {
+			break
+		}
+	}
+	go func() { rets <- C.listener_close_s2() }()
+	select {
+	case ret := <-rets:
+		if ret != 0 {
+			t.Errorf("tailscale_listener_close with a full backlog = %d: %s", ret, C.GoString(C.err))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("tailscale_listener_close with a full backlog did not return")
+	}
+}
+
+// testListenerAddr checks that tailscale_listener_addr reports the port
+// chosen for a listener on port 0, and that it accepts connections.
+func testListenerAddr(t *testing.T) {
+	const buflen = 64
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	if ret := C.tailscale_listener_addr(-1, buf, buflen); ret != C.EBADF {
+		t.Errorf("tailscale_listener_addr(-1) = %d, want EBADF", ret)
+	}
+
+	for _, addr := range []string{":8089", ":0"} {
+		caddr := C.CString(addr)
+		var ln C.tailscale_listener
+		ret := C.listen_addr_s2(caddr, &ln)
+		C.free(unsafe.Pointer(caddr))
+		if ret != 0 {
+			t.Errorf("tailscale_listen(%q): %s", addr, C.GoString(C.err))
+			continue
+		}
+		if ret := C.tailscale_listener_addr(ln, buf, 2); ret != C.ERANGE {
+			t.Errorf("tailscale_listener_addr(%q) with short buffer = %d, want ERANGE", addr, ret)
+		}
+		if ret := C.tailscale_listener_addr(ln, buf, buflen); ret != 0 {
+			t.Errorf("tailscale_listener_addr(%q) = %d", addr, ret)
+		}
+		got := C.GoString(buf)
+		_, port, err := net.SplitHostPort(got)
+		switch {
+		case err != nil:
+			t.Errorf("tailscale_listener_addr(%q) = %q: %v", addr, got, err)
+		case addr != ":0" && got != addr:
+			t.Errorf("tailscale_listener_addr(%q) = %q", addr, got)
+		case port == "0":
+			t.Errorf("tailscale_listener_addr(%q) = %q, want a chosen port", addr, got)
+		default:
+			cnetwork := C.CString("tcp")
+			cdial := C.CString("s2:" + port)
+			if C.dial_s1(cnetwork, cdial) != 0 {
+				t.Errorf("dial s2:%s: %s", port, C.GoString(C.err))
+			} else {
+				var c C.tailscale_conn
+				if ret := C.tailscale_accept_timeout(ln, 5000, &c); ret != 0 {
+					t.Errorf("accept on %q = %d", got, ret)
+				} else {
+					C.close(c)
+				}
+			}
+			C.free(unsafe.Pointer(cnetwork))
+			C.free(unsafe.Pointer(cdial))
+		}
+		C.tailscale_listener_close(ln)
+	}
+
+	// Concurrent listens on port 0 each get a port of their own.
+	const n = 8
+	caddr := C.CString(":0")
+	defer C.free(unsafe.Pointer(caddr))
+	lns := make(chan C.tailscale_listener, n)
+	for range n {
+		go func() {
+			var ln C.tailscale_listener
+			if C.listen_addr_s2(caddr, &ln) != 0 {
+				ln = -1
+			}
+			lns <- ln
+		}()
+	}
+	ports := map[string]bool{}
+	for range n {
+		ln := <-lns
+		if ln < 0 {
+			t.Errorf("concurrent tailscale_listen(:0) failed")
+			continue
+		}
+		defer C.tailscale_listener_close(ln)
+		if ret := C.tailscale_listener_addr(ln, buf, buflen); ret != 0 {
+			t.Errorf("tailscale_listener_addr = %d", ret)
+		} else if got := C.GoString(buf); ports[got] {
+			t.Errorf("concurrent tailscale_listen(:0) both got %s", got)
+		} else {
+			ports[got] = true
+		}
+	}
+}
+
+// testNetcheck runs a netcheck on s1 against the test DERP and STUN servers.
+func testNetcheck(t *testing.T) {
+	const buflen = 4096
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	if C.netcheck_s1(buf, buflen) != 0 {
+		t.Error(C.GoString(C.err))
+		return
+	}
+	var rep struct {
+		UDP           bool
+		IPv4          bool
+		GlobalV4      string
+		PreferredDERP int
+		Regions       []struct {
+			RegionID       int
+			LatencySeconds float64
+		}
+	}
+	if err := json.Unmarshal([]byte(C.GoString(buf)), &rep); err != nil {
+		t.Errorf("tailscale_netcheck: %v", err)
+		return
+	}
+	if !rep.UDP || !rep.IPv4 || rep.GlobalV4 == "" || rep.PreferredDERP == 0 || len(rep.Regions) == 0 || rep.Regions[0].LatencySeconds <= 0 {
+		t.Errorf("tailscale_netcheck = %s", C.GoString(buf))
+	}
+}
+
+// testExitNode makes s2 an exit node and has s1 use it.
+func testExitNode(t *testing.T, ctx context.Context, control *testcontrol.Server) {
+	const buflen = 4096
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	type exitNode struct {
+		ID     string
+		Name   string
+		Active bool
+	}
+	listExitNodes := func() []exitNode {
+		if C.list_exit_nodes_s1(buf, buflen) != 0 {
+			t.Fatal(C.GoString(C.err))
+		}
+		var nodes []exitNode
+		if err := json.Unmarshal([]byte(C.GoString(buf)), &nodes); err != nil {
+			t.Fatalf("tailscale_list_exit_nodes: %v", err)
+		}
+		return nodes
+	}
+	if nodes := listExitNodes(); len(nodes) != 0 {
+		t.Fatalf("exit nodes before s2 offers = %v, want none", nodes)
+	}
+
+	// Have s2 offer to be an exit node, and approve it as one that the
+	// tailnet suggests.
+	editPrefsS2 := func(json string) {
+		cjson := C.CString(json)
+		defer C.free(unsafe.Pointer(cjson))
+		if C.prefs_edit_s2(cjson) != 0 {
+			t.Fatal(C.GoString(C.err))
+		}
+	}
+	editPrefsS2(`{"AdvertiseRoutesSet": true, "AdvertiseRoutes": ["0.0.0.0/0", "::/0"]}`)
+	defer editPrefsS2(`{"AdvertiseRoutesSet": true, "AdvertiseRoutes": null}`)
+	for _, n := range control.AllNodes() {
+		if n.Hostinfo.Hostname() == "s2" {
+			control.SetSubnetRoutes(n.Key, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")})
+			control.SetNodeCapMap(n.Key, tailcfg.NodeCapMap{tailcfg.NodeAttrSuggestExitNode: nil})
+		}
+	}
+	var nodes []exitNode
+	for len(nodes) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("s2 never became an exit node for s1")
+		}
+		time.Sleep(10 * time.Millisecond)
+		nodes = listExitNodes()
+	}
+	if len(nodes) != 1 || nodes[0].Name != "s2.tail-scale.ts.net" || nodes[0].Active {
+		t.Fatalf("exit nodes = %v, want inactive s2", nodes)
+	}
+
+	if C.suggest_exit_node_s1(buf, buflen) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	var suggested exitNode
+	if err := json.Unmarshal([]byte(C.GoString(buf)), &suggested); err != nil {
+		t.Fatalf("tailscale_suggest_exit_node: %v", err)
+	}
+	if suggested.ID != nodes[0].ID {
+		t.Errorf("suggested exit node = %s, want %s", C.GoString(buf), nodes[0].ID)
+	}
+
+	cid := C.CString(suggested.ID)
+	defer C.free(unsafe.Pointer(cid))
+	if C.set_exit_node_s1(cid) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	if nodes := listExitNodes(); len(nodes) != 1 || !nodes[0].Active {
+		t.Errorf("exit nodes after set = %v, want active s2", nodes)
+	}
+	testExitTraffic(t)
+	if C.set_exit_node_s1(nil) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	if nodes := listExitNodes(); len(nodes) != 1 || nodes[0].Active {
+		t.Errorf("exit nodes after clear = %v, want inactive s2", nodes)
+	}
+}
+
+// testExitTraffic sends data from s1 to an address off the tailnet,
+// checking that it goes through s2, its exit node. tsnet does not
+// forward exit traffic itself, so s2 listens on the address.
+func testExitTraffic(t *testing.T) {
+	const addr = "203.0.113.1:8090" // TEST-NET-3, not on the tailnet
+	caddr := C.CString(addr)
+	defer C.free(unsafe.Pointer(caddr))
+	var ln C.tailscale_listener
+	if C.listen_addr_s2(caddr, &ln) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	defer C.tailscale_listener_close(ln)
+
+	cnetwork := C.CString("tcp")
+	defer C.free(unsafe.Pointer(cnetwork))
+	var conn C.tailscale_conn
+	if C.dial_conn_s1(cnetwork, caddr, &conn) != 0 {
+		t.Fatalf("dial %s through the exit node: %s", addr, C.GoString(C.err))
+	}
+	c1 := os.NewFile(uintptr(conn), "exit-conn")
+	defer c1.Close()
+	var accepted C.tailscale_conn
+	if ret := C.tailscale_accept_timeout(ln, 5000, &accepted); ret != 0 {
+		t.Fatalf("s2 accept on %s = %d", addr, ret)
+	}
+	c2 := os.NewFile(uintptr(accepted), "exit-accepted")
+	defer c2.Close()
+
+	want := "through s2"
+	if _, err := c1.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c2, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("s2 read %q through the exit node, want %q", got, want)
+	}
+}
+
+// testPrefs toggles a pref of s1.
+func testPrefs(t *testing.T) {
+	const buflen = 8192
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	routeAll := func() bool {
+		if C.prefs_get_s1(buf, buflen) != 0 {
+			t.Fatal(C.GoString(C.err))
+		}
+		var prefs struct{ RouteAll bool }
+		if err := json.Unmarshal([]byte(C.GoString(buf)), &prefs); err != nil {
+			t.Fatalf("tailscale_prefs_get_json: %v", err)
+		}
+		return prefs.RouteAll
+	}
+	orig := routeAll()
+	for _, want := range []bool{!orig, orig} {
+		edit := C.CString(fmt.Sprintf(`{"RouteAll": %v, "RouteAllSet": true}`, want))
+		ret := C.prefs_edit_s1(edit)
+		C.free(unsafe.Pointer(edit))
+		if ret != 0 {
+			t.Fatal(C.GoString(C.err))
+		}
+		if got := routeAll(); got != want {
+			t.Errorf("RouteAll = %v, want %v", got, want)
+		}
+	}
+
+	edit := C.CString(`{"RootAll": true, "RootAllSet": true}`)
+	defer C.free(unsafe.Pointer(edit))
+	if C.prefs_edit_s1(edit) == 0 {
+		t.Errorf("tailscale_prefs_edit_json with unknown pref succeeded")
+	}
+}
+
+// setOnline marks every node online, as testcontrol does not track
+// whether they are.
+func setOnline(control *testcontrol.Server) {
+	for _, n := range control.AllNodes() {
+		n.Online = ptr.To(true)
+		control.UpdateNode(n)
+	}
+	control.SetMasqueradeAddresses(nil) // sends every node a new netmap
+}
+
+// renameNodes acts as a control server that gives each node the
+// MagicDNS name for its hostname, which testcontrol does not, until the
+// returned function is called. If label is not nil, it returns the
+// first label of the name for a sanitized hostname.
+func renameNodes(ctx context.Context, control *testcontrol.Server, label func(string) string) (stop func()) {
+	if label == nil {
+		label = func(h string) string { return h }
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			nodes := control.AllNodes()
+			renamed := false
+			for _, n := range nodes {
+				if !n.Hostinfo.Valid() {
+					continue
+				}
+				want := label(dnsname.SanitizeHostname(n.Hostinfo.Hostname()))
+				first, rest, _ := strings.Cut(n.Name, ".")
+				if first != want {
+					n.Name = want + "." + rest
+					control.UpdateNode(n)
+					renamed = true
+				}
+			}
+			if renamed {
+				// Unlike ForceNetmapUpdate, this sends every node a new
+				// netmap without stopping the automatic ones that s2
+				// needs to switch profiles later.
+				control.SetMasqueradeAddresses(nil)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// selfName returns the MagicDNS name s2 has for itself.
+func selfName(t *testing.T) string {
+	const buflen = 4096
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+	if C.tailscale_self_json(C.s2, buf, buflen) != 0 {
+		t.Fatal("tailscale_self_json(s2) failed")
+	}
+	var self struct{ Name string }
+	if err := json.Unmarshal([]byte(C.GoString(buf)), &self); err != nil {
+		t.Fatal(err)
+	}
+	return self.Name
+}
+
+// testSetHostname renames the running s2, checking that its MagicDNS
+// name follows, and that a name the control server does not grant is
+// rolled back.
+func testSetHostname(t *testing.T, ctx context.Context, control *testcontrol.Server) {
+	stop := renameNodes(ctx, control, nil)
+	for _, name := range []string{"s2-renamed", "s2"} {
+		cname := C.CString(name)
+		ret := C.set_hostname_s2(cname)
+		C.free(unsafe.Pointer(cname))
+		if ret != 0 {
+			t.Fatal(C.GoString(C.err))
+		}
+		if got := selfName(t); got != name+".tail-scale.ts.net" {
+			t.Errorf("MagicDNS name after tailscale_set_hostname(%q) = %q", name, got)
+		}
+	}
+	stop()
+
+	// Setting the name the node already has brings no new netmap, and
+	// must not wait for one.
+	cname := C.CString("s2")
+	start := time.Now()
+	ret := C.set_hostname_s2(cname)
+	C.free(unsafe.Pointer(cname))
+	if ret != 0 {
+		t.Fatalf("tailscale_set_hostname(s2) again: %s", C.GoString(C.err))
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("tailscale_set_hostname(s2) again took %v", d)
+	}
+
+	// A control server that gives the node another name, as if the name
+	// were taken.
+	stop = renameNodes(ctx, control, func(h string) string {
+		if h == "s2-taken" {
+			return h + "-1"
+		}
+		return h
+	})
+	defer stop()
+	cname = C.CString("s2-taken")
+	ret = C.set_hostname_s2(cname)
+	C.free(unsafe.Pointer(cname))
+	if ret == 0 {
+		t.Fatal("tailscale_set_hostname(s2-taken) succeeded, want error for name s2-taken-1")
+	}
+	if msg := C.GoString(C.err); !strings.Contains(msg, "s2-taken-1") {
+		t.Errorf("tailscale_set_hostname(s2-taken) error = %q, want mention of s2-taken-1", msg)
+	}
+	// The hostname is restored, and with it the MagicDNS name.
+	var name string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if name = selfName(t); name == "s2.tail-scale.ts.net" {
+			break
+		}
+	}
+	if name != "s2.tail-scale.ts.net" {
+		t.Errorf("MagicDNS name after failed rename = %q, want s2.tail-scale.ts.net", name)
+	}
+}
+
+// testProfiles adds a second login profile to s2 and switches back.
+func testProfiles(t *testing.T, control *testcontrol.Server) {
+	const buflen = 4096
+	buf := (*C.char)(C.calloc(buflen, 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	type profile struct {
+		ID      string
+		Current bool
+	}
+	listProfiles := func() []profile {
+		if C.profiles_list_s2(buf, buflen) != 0 {
+			t.Fatal(C.GoString(C.err))
+		}
+		var profiles []profile
+		if err := json.Unmarshal([]byte(C.GoString(buf)), &profiles); err != nil {
+			t.Fatalf("tailscale_profiles_list: %v", err)
+		}
+		return profiles
+	}
+	orig := listProfiles()
+	if len(orig) != 1 || !orig[0].Current {
+		t.Fatalf("profiles = %v, want one current profile", orig)
+	}
+	ips := C.GoString(C.ips2)
+
+	// A failed login leaves s2 on its current profile.
+	badKey := C.CString("tskey-bad")
+	defer C.free(unsafe.Pointer(badKey))
+	control.RequireAuthKey = "tskey-profile"
+	if C.profile_add_s2(badKey) == 0 {
+		t.Error("tailscale_profile_add with a rejected key succeeded")
+	}
+	control.RequireAuthKey = ""
+	if profiles := listProfiles(); len(profiles) != 1 || profiles[0].ID != orig[0].ID || !profiles[0].Current {
+		t.Errorf("profiles after failed add = %v, want %v", profiles, orig)
+	}
+	// The control server also turned away s2's old profile when it came
+	// back, so s2 retries later; log it in again now.
+	if C.tailscale_up(C.s2) != 0 {
+		t.Fatal("tailscale_up after failed profile add failed")
+	}
+	if C.profiles_resync() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+
+	if C.profiles_setup() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	key := C.CString("tskey-profile")
+	defer C.free(unsafe.Pointer(key))
+
+	if C.profile_add_s2(key) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	if profiles := listProfiles(); len(profiles) != 2 {
+		t.Errorf("profiles after add = %v, want 2", profiles)
+	} else {
+		for _, p := range profiles {
+			if p.Current == (p.ID == orig[0].ID) {
+				t.Errorf("profiles after add = %v, want new profile current", profiles)
+			}
+		}
+	}
+	if C.profiles_check_closed() != 0 {
+		t.Error(C.GoString(C.err))
+	}
+
+	id := C.CString(orig[0].ID)
+	defer C.free(unsafe.Pointer(id))
+	if C.profile_switch_s2(id) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	for _, p := range listProfiles() {
+		if p.Current != (p.ID == orig[0].ID) {
+			t.Errorf("profile %s current = %v after switching back", p.ID, p.Current)
+		}
+	}
+	if C.profiles_check_port_ln() != 0 {
+		t.Error(C.GoString(C.err))
+	}
+	ipsBuf := (*C.char)(C.calloc(C.size_t(C.addrlen), 1))
+	defer C.free(unsafe.Pointer(ipsBuf))
+	if C.tailscale_getips(C.s2, ipsBuf, C.size_t(C.addrlen)) != 0 || C.GoString(ipsBuf) != ips {
+		t.Errorf("s2 IPs after switching back = %q, want %q", C.GoString(ipsBuf), ips)
+	}
+}
+
+// testDNSServer looks up s2 through a DNS server run by s1.
+func testDNSServer(t *testing.T, ctx context.Context) {
+	// Find a port that is free for both UDP and TCP.
+	var dnsAddr string
+	for dnsAddr == "" {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pc, err := net.ListenPacket("udp", ln.Addr().String()); err == nil {
+			dnsAddr = ln.Addr().String()
+			pc.Close()
+		}
+		ln.Close()
+	}
+
+	cport0 := C.CString("127.0.0.1:0")
+	defer C.free(unsafe.Pointer(cport0))
+	if C.dns_server_s1(cport0) == 0 {
+		t.Error("tailscale_dns_server(127.0.0.1:0) succeeded, want an error")
+	}
+
+	caddr := C.CString(dnsAddr)
+	defer C.free(unsafe.Pointer(caddr))
+	if C.dns_server_s1(caddr) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, dnsAddr)
+		},
+	}
+	ip2, _, _ := strings.Cut(C.GoString(C.ips2), ",")
+	var addrs []netip.Addr
+	var err error
+	for range 50 {
+		// The DNS server learns the netmap asynchronously.
+		addrs, err = r.LookupNetIP(ctx, "ip4", "s2.tail-scale.ts.net.")
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != ip2 {
+		t.Errorf("DNS server lookup of s2 = %v, want %v", addrs, ip2)
+	}
+}
+
+// testHTTPProxyGet fetches a page from s2 through the HTTP proxy on the
+// loopback server of s1.
+func testHTTPProxyGet(t *testing.T) {
+	ip2, _, _ := strings.Cut(C.GoString(C.ips2), ",")
+	target := "http://" + net.JoinHostPort(ip2, "8082") + "/hello"
+
+	get := func(user, pass string) (*http.Response, string) {
+		c, err := net.Dial("tcp", C.GoString(C.addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		}
+		if err := req.WriteProxy(c); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(b)
+	}
+
+	if res, _ := get("", ""); res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("GET without auth: %v, want 407", res.Status)
+	}
+	if res, _ := get("tsnet", "wrong"); res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("GET with bad auth: %v, want 407", res.Status)
+	}
+
+	// Serve one request on s2.
+	if C.listen_s2() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	srvErr := make(chan error, 1)
+	go func() {
+		var fd C.tailscale_conn
+		if C.accept_s2(&fd) != 0 {
+			srvErr <- errors.New(C.GoString(C.err))
+			return
+		}
+		r := os.NewFile(uintptr(fd), "conn")
+		defer r.Close()
+		req, err := http.ReadRequest(bufio.NewReader(r))
+		if err != nil {
+			srvErr <- err
+			return
+		}
+		if req.URL.Path != "/hello" || req.Header.Get("Proxy-Authorization") != "" {
+			srvErr <- fmt.Errorf("s2 got %s %s with Proxy-Authorization %q", req.Method, req.URL, req.Header.Get("Proxy-Authorization"))
+			return
+		}
+		_, err = io.WriteString(r, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello")
+		srvErr <- err
+	}()
+	res, body := get("tsnet", C.GoString(C.proxy_cred))
+	if res.StatusCode != 200 || body != "hello" {
+		t.Errorf("GET %s = %v %q, want 200 %q", target, res.Status, body, "hello")
+	}
+	if err := <-srvErr; err != nil {
+		t.Error(err)
+	}
+}
+
+// testHTTPConnect tunnels a connection to s2 through the HTTP proxy on
+// the loopback server of s1. It returns the client side of the tunnel,
+// still open.
+func testHTTPConnect(t *testing.T) net.Conn {
+	if C.listen_s2() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	ip2, _, _ := strings.Cut(C.GoString(C.ips2), ",")
+	target := net.JoinHostPort(ip2, "8082")
+
+	connect := func(user, pass string) (net.Conn, *http.Response) {
+		c, err := net.Dial("tcp", C.GoString(C.addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: target},
+			Host:   target,
+			Header: http.Header{},
+		}
+		if user != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		}
+		if err := req.Write(c); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, res
+	}
+
+	c, res := connect("", "")
+	c.Close()
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("CONNECT without auth: %v, want 407", res.Status)
+	}
+	c, res = connect("tsnet", "wrong")
+	c.Close()
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("CONNECT with bad auth: %v, want 407", res.Status)
+	}
+
+	c, res = connect("tsnet", C.GoString(C.proxy_cred))
+	if res.StatusCode != 200 {
+		c.Close()
+		t.Fatalf("CONNECT %s: %v", target, res.Status)
+	}
+	want := "hello via http proxy"
+	if _, err := io.WriteString(c, want); err != nil {
+		t.Fatal(err)
+	}
+
+	var fd C.tailscale_conn
+	if C.accept_s2(&fd) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	r := os.NewFile(uintptr(fd), "conn")
+	defer r.Close()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q via CONNECT, want %q", got, want)
+	}
+	return c
+}
+
+// dialSOCKS opens an authenticated SOCKS5 connection to the loopback
+// server of s1, which is left waiting for a request.
+func dialSOCKS(t *testing.T) net.Conn {
+	c, err := net.Dial("tcp", C.GoString(C.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	cred := C.GoString(C.proxy_cred)
+	var req []byte
+	req = append(req, 5, 1, 2)                       // greeting, password auth
+	req = append(req, 1, 5, 't', 's', 'n', 'e', 't') // username
+	req = append(req, byte(len(cred)))
+	req = append(req, cred...)
+	res := make([]byte, 2+2)
+	if _, err := c.Write(req); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, res); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	if res[1] != 2 || res[3] != 0 {
+		c.Close()
+		t.Fatalf("SOCKS5 auth failed: % x", res)
+	}
+	return c
+}
+
+// testSOCKSUDP relays a datagram to s2 and back through a SOCKS5
+// UDP association on the loopback server of s1.
+func testSOCKSUDP(t *testing.T) {
+	if C.listen_s2_udp() != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	ip2, _, _ := strings.Cut(C.GoString(C.ips2), ",")
+	target := netip.AddrPortFrom(netip.MustParseAddr(ip2), 5300)
+
+	c, err := net.Dial("tcp", C.GoString(C.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	cred := C.GoString(C.proxy_cred)
+	var req []byte
+	req = append(req, 5, 1, 2)                       // greeting, password auth
+	req = append(req, 1, 5, 't', 's', 'n', 'e', 't') // username
+	req = append(req, byte(len(cred)))
+	req = append(req, cred...)
+	req = append(req, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0) // UDP ASSOCIATE 0.0.0.0:0
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, 2+2+10)
+	if _, err := io.ReadFull(c, res); err != nil {
+		t.Fatal(err)
+	}
+	if res[1] != 2 || res[3] != 0 || res[5] != 0 {
+		t.Fatalf("UDP ASSOCIATE failed: % x", res)
+	}
+	relay := netip.AddrPortFrom(netip.AddrFrom4([4]byte(res[8:12])), binary.BigEndian.Uint16(res[12:14]))
+
+	uc, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(relay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(10 * time.Second))
+
+	hdr := []byte{0, 0, 0, 1}
+	hdr = append(hdr, target.Addr().AsSlice()...)
+	hdr = binary.BigEndian.AppendUint16(hdr, target.Port())
+	if _, err := uc.Write(append(hdr, "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	var fd C.tailscale_conn
+	if C.accept_s2_udp(&fd) != 0 {
+		t.Fatal(C.GoString(C.err))
+	}
+	pc := os.NewFile(uintptr(fd), "conn")
+	defer pc.Close()
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(pc, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("got %q via UDP ASSOCIATE, want %q", got, "ping")
+	}
+	if _, err := io.WriteString(pc, "pong"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < len(hdr) || !bytes.Equal(buf[:len(hdr)], hdr) {
+		t.Errorf("reply header = % x, want % x", buf[:min(n, len(hdr))], hdr)
+	} else if got := string(buf[len(hdr):n]); got != "pong" {
+		t.Errorf("reply = %q, want %q", got, "pong")
+	}
+}
+
+// getLocalAPI fetches url from a loopback LocalAPI server using cred,
+// returning the status code and body.
+func getLocalAPI(t *testing.T, ctx context.Context, url, cred string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Sec-Tailscale", "localapi")
+	req.SetBasicAuth("", cred)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
 	}
+	return res.StatusCode, b
 }